@@ -0,0 +1,732 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/klauspost/reedsolomon"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// An archive is a *.pres file, that contains a directory tree. Its data
+// consists of the contents of all files, followed by an index, that
+// describes the entries of the tree. The location of the index is
+// stored in the conf, so that single files can be read without
+// reading the whole data. In compressed archives, the index precedes
+// the contents, because compressed data can only be read from the start.
+
+// archiveDirname is set with -a and extractPath with -path. outFilename
+// is set with -o.
+var (
+	archiveDirname string
+	extractPath    string
+	outFilename    string
+)
+
+// archive locates the index within the data. The zero value describes
+// a *.pres file, that is no archive.
+type archive struct {
+	indexOffset, indexLen int64
+}
+
+func (a archive) isEnabled() bool {
+	return a.indexLen > 0
+}
+
+// archiveEntry describes a directory, regular file or symbolic link in
+// an archive. The data of a symbolic link is its target.
+type archiveEntry struct {
+	path     string // Relative, slash separated path.
+	mode     os.FileMode
+	modified int64
+	offset   int64
+	size     int64
+	sha256   [sha256.Size]byte
+}
+
+const archiveIndexMagic = "PRESINDX"
+
+// createArchiveFile writes the contents of dirname and the index to a
+// new temporary file in dir and returns its name and the archive.
+func createArchiveFile(dirname, dir string) (string, archive, error) {
+	tmpFile, err := createTempFile(dir, ".pres_create_*")
+	if err != nil {
+		return "", archive{}, err
+	}
+	var entries []archiveEntry
+	var offset int64
+	err = filepath.Walk(dirname, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(dirname, filename)
+		if err != nil || relPath == "." {
+			return err
+		}
+		entry := archiveEntry{
+			path:     filepath.ToSlash(relPath),
+			mode:     info.Mode(),
+			modified: info.ModTime().UnixNano(),
+			offset:   offset,
+		}
+		var content io.Reader
+		switch {
+		case info.Mode().IsDir():
+		case info.Mode().IsRegular():
+			file, err := os.Open(filename)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			content = file
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(filename)
+			if err != nil {
+				return err
+			}
+			content = strings.NewReader(target)
+		default:
+			fmt.Fprintf(os.Stderr, "Skipping '%s', because it is no regular file, directory or symbolic link.\n",
+				filename)
+			return nil
+		}
+		if content != nil {
+			hasher := sha256.New()
+			if entry.size, err = io.Copy(io.MultiWriter(tmpFile, hasher), content); err != nil {
+				return err
+			}
+			copy(entry.sha256[:], hasher.Sum(nil))
+			offset += entry.size
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	var a archive
+	if err == nil {
+		a.indexOffset = offset
+		index := encodeArchiveIndex(entries)
+		a.indexLen = int64(len(index))
+		_, err = tmpFile.Write(index)
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return "", archive{}, err
+	}
+	return tmpFile.Name(), a, nil
+}
+
+// moveArchiveIndexToFront returns a reader of the archive in file, with
+// the index in front of the contents, and the archive, that describes
+// this layout.
+func moveArchiveIndexToFront(file io.ReaderAt, a archive) (io.Reader, archive, error) {
+	index := make([]byte, a.indexLen)
+	if _, err := file.ReadAt(index, a.indexOffset); err != nil {
+		return nil, archive{}, err
+	}
+	entries, err := decodeArchiveIndex(index, a.indexOffset)
+	if err != nil {
+		return nil, archive{}, err
+	}
+	// The length of the index does not depend on the offsets:
+	for i := range entries {
+		entries[i].offset += a.indexLen
+	}
+	index = encodeArchiveIndex(entries)
+	contents := io.NewSectionReader(file, 0, a.indexOffset)
+	return io.MultiReader(bytes.NewReader(index), contents), archive{0, a.indexLen}, nil
+}
+
+// encodeArchiveIndex encodes the entries after archiveIndexMagic and
+// their count as uint32. Each entry consists of the path, prefixed with
+// its length as uint16, the mode as uint32, the modification time,
+// offset and size as uint64 and the SHA-256 digest.
+func encodeArchiveIndex(entries []archiveEntry) []byte {
+	b := new(bytes.Buffer)
+	b.WriteString(archiveIndexMagic)
+	binary.Write(b, binary.BigEndian, uint32(len(entries)))
+	for _, entry := range entries {
+		binary.Write(b, binary.BigEndian, uint16(len(entry.path)))
+		b.WriteString(entry.path)
+		binary.Write(b, binary.BigEndian, uint32(entry.mode))
+		binary.Write(b, binary.BigEndian, entry.modified)
+		binary.Write(b, binary.BigEndian, entry.offset)
+		binary.Write(b, binary.BigEndian, entry.size)
+		b.Write(entry.sha256[:])
+	}
+	return b.Bytes()
+}
+
+// decodeArchiveIndex is the inverse of encodeArchiveIndex. Entries with
+// paths, that would lead out of the extracted tree, or data beyond
+// dataEnd are rejected.
+func decodeArchiveIndex(b []byte, dataEnd int64) ([]archiveEntry, error) {
+	errInvalid := errors.New("the archive index is invalid")
+	if !bytes.HasPrefix(b, []byte(archiveIndexMagic)) {
+		return nil, errInvalid
+	}
+	r := bytes.NewReader(b[len(archiveIndexMagic):])
+	var entryCnt uint32
+	if err := binary.Read(r, binary.BigEndian, &entryCnt); err != nil {
+		return nil, errInvalid
+	}
+	var entries []archiveEntry
+	for i := uint32(0); i < entryCnt; i += 1 {
+		var entry archiveEntry
+		var pathLen uint16
+		var mode uint32
+		if err := binary.Read(r, binary.BigEndian, &pathLen); err != nil {
+			return nil, errInvalid
+		}
+		p := make([]byte, pathLen)
+		if _, err := io.ReadFull(r, p); err != nil {
+			return nil, errInvalid
+		}
+		entry.path = string(p)
+		for _, x := range []interface{}{&mode, &entry.modified, &entry.offset, &entry.size, &entry.sha256} {
+			if err := binary.Read(r, binary.BigEndian, x); err != nil {
+				return nil, errInvalid
+			}
+		}
+		entry.mode = os.FileMode(mode)
+		if !isLocalPath(entry.path) || entry.offset < 0 || entry.size < 0 ||
+			entry.offset+entry.size > dataEnd || entry.offset+entry.size < 0 {
+			return nil, errInvalid
+		}
+		entries = append(entries, entry)
+	}
+	if r.Len() > 0 {
+		return nil, errInvalid
+	}
+	return entries, nil
+}
+
+// isLocalPath reports whether p is a relative, slash separated path,
+// that stays within the directory it is relative to.
+func isLocalPath(p string) bool {
+	return p != "" && path.Clean(p) == p && !path.IsAbs(p) &&
+		p != ".." && !strings.HasPrefix(p, "../") && !strings.Contains(p, "\\")
+}
+
+// readDataRange writes size bytes of the data of inFilename, starting at
+// offset, to w. Only the shards, that contain the range, are checked.
+// If one of them is damaged, further shards are checked, until enough
+// intact ones are known to reconstruct the range from them.
+func readDataRange(inFilename string, conf conf, offset, size int64, w io.Writer) error {
+	if err := checkHMACKey(conf); err != nil {
+		return err
+	} else if err = checkKeyed(conf); err != nil {
+		return err
+	}
+	file, err := openShards(inFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	// Unchecked shards are treated as damaged, so they are not used.
+	shardStates := make([]bool, conf.shardCnt())
+	hasher := hashAlgorithms[conf.hashAlgorithm]()
+	checkShard := func(i int) bool {
+		shardOffset, shardSize := getShardBounds(conf, i)
+		hasher.Reset()
+		err := copyShard(hasher, newShardReader(file, shardOffset, shardSize), nil)
+		shardStates[i] = err == nil && formatSum(conf.hashAlgorithm, hasher.Sum(nil)) == conf.shardHashes[i]
+		return shardStates[i]
+	}
+	shardSize := calculateShardSize(conf.dataLen, conf.dataShardCnt)
+	first, last := int(offset/shardSize), int((offset+size-1)/shardSize)
+	intactCnt, intact := 0, true
+	for i := first; i <= last; i += 1 {
+		if checkShard(i) {
+			intactCnt += 1
+		} else {
+			intact = false
+		}
+	}
+	if intact {
+		_, err = io.Copy(w, io.NewSectionReader(file, offset, size))
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, "Needed shards are damaged; reconstructing them.")
+	for i := 0; i < len(shardStates) && intactCnt < int(conf.dataShardCnt); i += 1 {
+		if (i < first || i > last) && checkShard(i) {
+			intactCnt += 1
+		}
+	}
+	if intactCnt < int(conf.dataShardCnt) {
+		return errors.New("not enough shards are intact")
+	}
+	return reconstructRange(file, conf, shardStates, offset, size, w)
+}
+
+// reconstructRange writes size bytes of the data, starting at offset, to
+// w. Damaged shards are reconstructed, but only in the columns, that
+// overlap the range.
+func reconstructRange(file io.ReaderAt, conf conf, shardStates []bool, offset, size int64, w io.Writer) error {
+	r, err := newStripeReconstructor(conf)
+	if err != nil {
+		return err
+	}
+	defer r.close()
+	shardSize := calculateShardSize(conf.dataLen, conf.dataShardCnt)
+	buf := make([]byte, min64(reconstructStripeSize, shardSize))
+	shardStates = append([]bool(nil), shardStates...)
+	for size > 0 {
+		column := offset % shardSize
+		stripe := buf[:min64(min64(size, shardSize-column), reconstructStripeSize)]
+		if err = r.reconstruct(file, shardStates, offset, stripe); err != nil {
+			return err
+		}
+		if _, err = w.Write(stripe); err != nil {
+			return err
+		}
+		offset += int64(len(stripe))
+		size -= int64(len(stripe))
+	}
+	return nil
+}
+
+// reconstructStripeSize is the maximum length of a reconstructed stripe.
+// It is smaller than readAheadSize, because a buffer of this size is
+// needed for every shard.
+const reconstructStripeSize = 256 << 10
+
+// stripeReconstructor reconstructs stripes of the data from the shards,
+// that are not damaged. Its buffers are reused for every stripe.
+//
+// All damaged data shards of a stripe are reconstructed at once. The data
+// is read in order, so the stripes of the damaged data shards behind the
+// requested one are kept in a temporary file, until they are requested;
+// this way every stripe is only reconstructed once.
+type stripeReconstructor struct {
+	conf    conf
+	enc     reedsolomon.Encoder
+	buffers [][]byte
+	shards  [][]byte
+	cache   *os.File      // Holds shard j at offset j*shardSize.
+	cached  []columnRange // The columns of each shard, that are in cache.
+}
+
+type columnRange struct {
+	start, end int64
+}
+
+func newStripeReconstructor(conf conf) (*stripeReconstructor, error) {
+	enc, err := reedsolomon.New(int(conf.dataShardCnt), int(conf.parityShardCnt))
+	if err != nil {
+		return nil, err
+	}
+	shardSize := calculateShardSize(conf.dataLen, conf.dataShardCnt)
+	buffers := make([][]byte, conf.shardCnt())
+	for i := range buffers {
+		buffers[i] = make([]byte, min64(reconstructStripeSize, shardSize))
+	}
+	return &stripeReconstructor{
+		conf:    conf,
+		enc:     enc,
+		buffers: buffers,
+		shards:  make([][]byte, len(buffers)),
+		cached:  make([]columnRange, conf.dataShardCnt),
+	}, nil
+}
+
+// close removes the temporary file of r.
+func (r *stripeReconstructor) close() {
+	if r.cache != nil {
+		r.cache.Close()
+		os.Remove(r.cache.Name())
+	}
+}
+
+// reconstruct fills p with the data, that starts at offset. The range
+// must not cross the end of a data shard or exceed reconstructStripeSize
+// bytes. Shards, that cannot be read, are marked as damaged in
+// shardStates and treated as erasures.
+func (r *stripeReconstructor) reconstruct(file io.ReaderAt, shardStates []bool, offset int64, p []byte) error {
+	shardSize := calculateShardSize(r.conf.dataLen, r.conf.dataShardCnt)
+	i := offset / shardSize
+	column := offset - i*shardSize
+	n := int64(len(p))
+	if c := r.cached[i]; c.start <= column && column+n <= c.end {
+		return readFull(r.cache, p, offset)
+	}
+	for j := range r.shards {
+		if shardStates[j] == damaged {
+			r.shards[j] = r.buffers[j][:0]
+			continue
+		}
+		r.shards[j] = r.buffers[j][:n]
+		shardOffset, shardLen := getShardBounds(r.conf, j)
+		readLen := max64(0, min64(n, shardLen-column))
+		if err := readFull(file, r.shards[j][:readLen], shardOffset+column); err != nil {
+			fmt.Fprintf(os.Stderr, "Shard %d is unreadable: %s\n", j+1, err.Error())
+			shardStates[j] = damaged
+			r.shards[j] = r.buffers[j][:0]
+			continue
+		}
+		// Like in fillLastDataReader:
+		for k := readLen; k < n; k += 1 {
+			r.shards[j][k] = '0'
+		}
+	}
+	if err := r.enc.Reconstruct(r.shards); err == reedsolomon.ErrTooFewShards {
+		return errors.New("not enough shards are readable")
+	} else if err != nil {
+		return err
+	}
+	if isOK, err := r.enc.Verify(r.shards); err != nil {
+		return err
+	} else if !isOK {
+		return errors.New("parity shards contain wrong data")
+	}
+	copy(p, r.shards[i])
+	for j := int(i) + 1; j < int(r.conf.dataShardCnt); j += 1 {
+		if shardStates[j] == damaged {
+			if err := r.cacheStripe(j, column, r.shards[j]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// cacheStripe writes the reconstructed stripe of data shard j, that
+// starts at column, to the temporary file of r.
+func (r *stripeReconstructor) cacheStripe(j int, column int64, stripe []byte) error {
+	var err error
+	if r.cache == nil {
+		if r.cache, err = createTempFile("", "pres_reconstruct_*"); err != nil {
+			return err
+		}
+	}
+	shardSize := calculateShardSize(r.conf.dataLen, r.conf.dataShardCnt)
+	if _, err = r.cache.WriteAt(stripe, int64(j)*shardSize+column); err != nil {
+		return err
+	}
+	end := column + int64(len(stripe))
+	if c := &r.cached[j]; c.end == column && c.start < c.end {
+		c.end = end
+	} else {
+		*c = columnRange{column, end}
+	}
+	return nil
+}
+
+// readArchiveIndex reads the index of an archive or a tar file.
+func readArchiveIndex(inFilename string, conf conf) ([]archiveEntry, error) {
+	if conf.tarIndex != nil {
+		return decodeArchiveIndex(conf.tarIndex, conf.dataLen)
+	}
+	var b bytes.Buffer
+	err := readArchiveRange(inFilename, conf, conf.archive.indexOffset, conf.archive.indexLen, &b)
+	if err != nil {
+		return nil, err
+	}
+	return decodeArchiveIndex(b.Bytes(), archiveDataEnd(conf))
+}
+
+// archiveDataEnd returns the offset, up to which the contents of the
+// files of an archive may be stored.
+func archiveDataEnd(conf conf) int64 {
+	if conf.compression.isEnabled() {
+		return conf.compression.origLen
+	}
+	return conf.archive.indexOffset
+}
+
+// readArchiveRange is like readDataRange, but for compressed archives,
+// offset and size refer to the decompressed data. It is then
+// decompressed from the start and shards are checked, one after the
+// other, until the range was read.
+func readArchiveRange(inFilename string, conf conf, offset, size int64, w io.Writer) error {
+	if !conf.compression.isEnabled() {
+		return readDataRange(inFilename, conf, offset, size, w)
+	}
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		var err error
+		for i := 0; i < int(conf.dataShardCnt) && err == nil; i += 1 {
+			shardOffset, shardSize := getShardBounds(conf, i)
+			err = readDataRange(inFilename, conf, shardOffset, shardSize, pw)
+		}
+		pw.CloseWithError(err)
+	}()
+	zr, err := conf.compression.newReader(pr)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	if _, err = io.CopyN(ioutil.Discard, zr, offset); err != nil {
+		return err
+	}
+	_, err = io.CopyN(w, zr, size)
+	return err
+}
+
+// getArchiveConf reads the conf of inFilename and exits, if the file is
+// neither an archive nor a tar file with an index.
+func getArchiveConf(inFilename string) conf {
+	conf, err := getConf(inFilename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading *.pres file:", err.Error())
+		os.Exit(2)
+	}
+	if !conf.archive.isEnabled() && conf.tarIndex == nil {
+		fmt.Fprintf(os.Stderr, "'%s' is neither an archive nor a tar file with an index.\n", inFilename)
+		os.Exit(1)
+	}
+	return conf
+}
+
+func listArchive(inFilename string) {
+	conf := getArchiveConf(inFilename)
+	entries, err := readArchiveIndex(inFilename, conf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading archive index:", err.Error())
+		os.Exit(2)
+	}
+	for _, entry := range entries {
+		fmt.Printf("%s %12d %s %s\n", entry.mode, entry.size,
+			time.Unix(0, entry.modified).Format("2006-01-02 15:04"), entry.path)
+	}
+}
+
+// extractFromArchive writes the file at extractPath within the archive
+// to outFilename or, if it is empty, to the base name of extractPath.
+func extractFromArchive(inFilename string) {
+	if extractPath == "" {
+		fmt.Fprintln(os.Stderr, "Give the file to extract with -path.")
+		os.Exit(1)
+	}
+	conf := getArchiveConf(inFilename)
+	entries, err := readArchiveIndex(inFilename, conf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading archive index:", err.Error())
+		os.Exit(2)
+	}
+	for _, entry := range entries {
+		if entry.path != extractPath {
+			continue
+		} else if !entry.mode.IsRegular() {
+			fmt.Fprintf(os.Stderr, "'%s' is no regular file.\n", extractPath)
+			os.Exit(1)
+		}
+		filename := outFilename
+		if filename == "" {
+			filename = path.Base(entry.path)
+		}
+		fmt.Fprintf(os.Stderr, "Extracting '%s' to '%s'.\n", entry.path, filename)
+		if err = extractEntry(inFilename, conf, entry, filename); err != nil {
+			fmt.Fprintln(os.Stderr, "Error extracting file:", err.Error())
+			os.Exit(3)
+		}
+		return
+	}
+	fmt.Fprintf(os.Stderr, "'%s' is not in the archive.\n", extractPath)
+	os.Exit(1)
+}
+
+func extractEntry(inFilename string, conf conf, entry archiveEntry, filename string) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, entry.mode.Perm())
+	if err != nil {
+		return err
+	}
+	hasher := sha256.New()
+	err = readArchiveRange(inFilename, conf, entry.offset, entry.size, io.MultiWriter(file, hasher))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && !bytes.Equal(hasher.Sum(nil), entry.sha256[:]) {
+		err = errors.New("the extracted data does not match its digest")
+	}
+	if err != nil {
+		os.Remove(filename)
+		return err
+	}
+	modified := time.Unix(0, entry.modified)
+	return os.Chtimes(filename, modified, modified)
+}
+
+// unpackArchive recreates the entries in outDirname from data, the data
+// of an archive from offset on, which is read in order. The permissions
+// and modification times of directories are set later, by
+// finishDirectories.
+func unpackArchive(data io.Reader, offset int64, entries []archiveEntry, outDirname string) error {
+	for _, entry := range entries {
+		if entry.offset < offset {
+			return errors.New("the entries of the archive are not in order")
+		}
+		if _, err := io.CopyN(ioutil.Discard, data, entry.offset-offset); err != nil {
+			return err
+		}
+		offset = entry.offset
+		filename := filepath.Join(outDirname, filepath.FromSlash(entry.path))
+		var err error
+		switch {
+		case entry.mode.IsDir():
+			// The permissions are set later, in case they forbid writing.
+			err = os.MkdirAll(filename, 0700)
+		case entry.mode&os.ModeSymlink != 0:
+			target := make([]byte, entry.size)
+			if _, err = io.ReadFull(data, target); err == nil {
+				err = os.Symlink(string(target), filename)
+			}
+			offset += entry.size
+		case entry.mode.IsRegular():
+			err = unpackFile(data, entry, filename)
+			offset += entry.size
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finishDirectories sets the permissions and modification times of the
+// unpacked directories. Changing the contents of a directory changes its
+// modification time, so this is done last, innermost first.
+func finishDirectories(entries []archiveEntry, outDirname string) error {
+	for i := len(entries) - 1; i >= 0; i -= 1 {
+		entry := entries[i]
+		if !entry.mode.IsDir() {
+			continue
+		}
+		filename := filepath.Join(outDirname, filepath.FromSlash(entry.path))
+		if info, err := os.Lstat(filename); err != nil {
+			return err
+		} else if !info.IsDir() {
+			return fmt.Errorf("'%s' is no directory", filename)
+		}
+		if err := os.Chmod(filename, entry.mode.Perm()); err != nil {
+			return err
+		}
+		modified := time.Unix(0, entry.modified)
+		if err := os.Chtimes(filename, modified, modified); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkArchiveEntries makes sure, that unpacking the entries cannot
+// write outside of the tree: every path must occur only once and no
+// entry may lie behind a symbolic link of the archive.
+func checkArchiveEntries(entries []archiveEntry) error {
+	paths := make(map[string]bool)
+	symlinks := make(map[string]bool)
+	for _, entry := range entries {
+		if paths[entry.path] {
+			return fmt.Errorf("'%s' occurs more than once in the archive", entry.path)
+		}
+		paths[entry.path] = true
+		for dir := path.Dir(entry.path); dir != "."; dir = path.Dir(dir) {
+			if symlinks[dir] {
+				return fmt.Errorf("'%s' lies behind the symbolic link '%s'", entry.path, dir)
+			}
+		}
+		if entry.mode&os.ModeSymlink != 0 {
+			symlinks[entry.path] = true
+		}
+	}
+	return nil
+}
+
+func unpackFile(data io.Reader, entry archiveEntry, filename string) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, entry.mode.Perm())
+	if err != nil {
+		return err
+	}
+	hasher := sha256.New()
+	_, err = io.CopyN(io.MultiWriter(file, hasher), data, entry.size)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && !bytes.Equal(hasher.Sum(nil), entry.sha256[:]) {
+		err = fmt.Errorf("the data of '%s' does not match its digest", entry.path)
+	}
+	if err != nil {
+		return err
+	}
+	modified := time.Unix(0, entry.modified)
+	return os.Chtimes(filename, modified, modified)
+}
+
+// restoreArchive recreates the tree of an archive in outDirname. The
+// index is read first, so that the entries can be unpacked, while the
+// data is restored.
+func restoreArchive(inFilename, outDirname string, shardStates []bool, conf conf) error {
+	var entries []archiveEntry
+	var err error
+	if !conf.compression.isEnabled() {
+		if entries, err = readArchiveIndex(inFilename, conf); err != nil {
+			return err
+		}
+		if err = checkArchiveEntries(entries); err != nil {
+			return err
+		}
+	}
+	file, err := openShards(inFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err = os.Mkdir(outDirname, 0755); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Unpacking the archive to '%s'.\n", outDirname)
+	unpack := func(r io.Reader) error {
+		if !conf.compression.isEnabled() {
+			return unpackArchive(r, 0, entries, outDirname)
+		}
+		zr, err := conf.compression.newReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		// The index is at the start of the decompressed data:
+		index := make([]byte, conf.archive.indexLen)
+		if _, err = io.ReadFull(zr, index); err != nil {
+			return err
+		}
+		if entries, err = decodeArchiveIndex(index, archiveDataEnd(conf)); err != nil {
+			return err
+		} else if err = checkArchiveEntries(entries); err != nil {
+			return err
+		}
+		if err = unpackArchive(zr, conf.archive.indexLen, entries, outDirname); err != nil {
+			return err
+		}
+		// Reading to the end checks the integrity of the compressed data.
+		_, err = io.Copy(ioutil.Discard, zr)
+		return err
+	}
+	write := func(shardStates []bool) error {
+		return pipeData(file, shardStates, conf, unpack)
+	}
+	reset := func() error {
+		if err := os.RemoveAll(outDirname); err != nil {
+			return err
+		}
+		return os.Mkdir(outDirname, 0755)
+	}
+	if err = restoreTo(inFilename, shardStates, conf, write, reset); err == nil {
+		err = finishDirectories(entries, outDirname)
+	}
+	if err != nil {
+		os.RemoveAll(outDirname)
+	}
+	return err
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	for _, codec := range []string{"", "gzip"} {
+		testArchiveRoundTrip(t, codec)
+	}
+}
+
+func testArchiveRoundTrip(t *testing.T, codec string) {
+	dir, err := ioutil.TempDir("", "pres_test_archive_*")
+	if err != nil {
+		t.Fatalf("Error creating temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	inDirname := filepath.Join(dir, "in")
+	files := map[string][]byte{
+		"a":       bytes.Repeat([]byte("a"), 100000),
+		"sub/b":   []byte("b"),
+		"sub/c/d": bytes.Repeat([]byte("d"), 5000),
+	}
+	for name, content := range files {
+		filename := filepath.Join(inDirname, filepath.FromSlash(name))
+		if err = os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatalf("Error creating directory: %s", err.Error())
+		}
+		if err = ioutil.WriteFile(filename, content, 0644); err != nil {
+			t.Fatalf("Error writing file: %s", err.Error())
+		}
+	}
+	presFilename := filepath.Join(dir, "in.pres")
+	defer func() { archiveDirname, compressCodec = "", "" }()
+	archiveDirname, compressCodec = inDirname, codec
+	createPresFile(inDirname)
+	archiveDirname, compressCodec = "", ""
+
+	conf, err := getConf(presFilename)
+	if err != nil {
+		t.Fatalf("Error reading conf: %s", err.Error())
+	}
+	if conf.compression.codec != codec {
+		t.Errorf("The archive is compressed with '%s' instead of '%s'", conf.compression.codec, codec)
+	}
+	if err = damageShard(presFilename, conf, 0); err != nil {
+		t.Fatalf("Error damaging shard: %s", err.Error())
+	}
+	entries, err := readArchiveIndex(presFilename, conf)
+	if err != nil {
+		t.Fatalf("Error reading index: %s", err.Error())
+	}
+	if len(entries) != 5 {
+		t.Errorf("Got %d entries instead of 5", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.path != "sub/c/d" {
+			continue
+		}
+		outFilename := filepath.Join(dir, "d")
+		if err = extractEntry(presFilename, conf, entry, outFilename); err != nil {
+			t.Fatalf("Error extracting: %s", err.Error())
+		}
+		if content, _ := ioutil.ReadFile(outFilename); !bytes.Equal(content, files["sub/c/d"]) {
+			t.Errorf("Extracted file differs from the original")
+		}
+	}
+
+	// The damage is found while unpacking, so the tree is unpacked again.
+	outDirname := filepath.Join(dir, "out")
+	if err = restoreArchive(presFilename, outDirname, nil, conf); err != nil {
+		t.Fatalf("Error restoring: %s", err.Error())
+	}
+	for name, content := range files {
+		restored, err := ioutil.ReadFile(filepath.Join(outDirname, filepath.FromSlash(name)))
+		if err != nil || !bytes.Equal(restored, content) {
+			t.Errorf("Restored '%s' differs from the original: %v", name, err)
+		}
+	}
+}
+
+func TestArchiveIndexRejectsEscapingPaths(t *testing.T) {
+	for _, p := range []string{"../a", "/a", "a/../../b", "a//b", "", ".."} {
+		index := encodeArchiveIndex([]archiveEntry{{path: p}})
+		if _, err := decodeArchiveIndex(index, 0); err == nil {
+			t.Errorf("Path '%s' was accepted", p)
+		}
+	}
+}
+
+func TestArchiveEntriesCannotEscapeThroughSymlinks(t *testing.T) {
+	symlink := archiveEntry{path: "x", mode: os.ModeSymlink | 0777}
+	for _, entries := range [][]archiveEntry{
+		{symlink, {path: "x", mode: os.ModeDir | 0755}},
+		{symlink, {path: "x/y", mode: 0644}},
+		{{path: "y", mode: 0644}, {path: "y", mode: 0600}},
+	} {
+		if err := checkArchiveEntries(entries); err == nil {
+			t.Errorf("Entries %v were accepted", entries)
+		}
+	}
+	entries := []archiveEntry{{path: "x", mode: os.ModeDir | 0755}, {path: "x/y", mode: 0644}}
+	if err := checkArchiveEntries(entries); err != nil {
+		t.Errorf("Valid entries were rejected: %s", err.Error())
+	}
+}
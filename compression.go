@@ -0,0 +1,109 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressCodec is set with -compress. The data is compressed before it
+// is encrypted and sharded, so verify, upgrade and reencode work on the
+// compressed data.
+var compressCodec string
+
+// compression describes how the data of a *.pres file is compressed. The
+// zero value describes uncompressed data.
+type compression struct {
+	codec   string // "gzip" or "zstd".
+	origLen int64  // The length before compression.
+}
+
+func (c compression) isEnabled() bool {
+	return c.codec != ""
+}
+
+func checkCompressCodec(codec string) error {
+	if codec != "" && codec != "gzip" && codec != "zstd" {
+		return fmt.Errorf("unsupported compression '%s'", codec)
+	}
+	return nil
+}
+
+// compressToTempFile compresses the data from r with codec to a new
+// temporary file in dir and returns its name.
+func compressToTempFile(r io.Reader, dir, codec string) (string, error) {
+	if err := checkCompressCodec(codec); err != nil {
+		return "", err
+	}
+	tmpFile, err := createTempFile(dir, ".pres_create_*")
+	if err != nil {
+		return "", err
+	}
+	var w io.WriteCloser = gzip.NewWriter(tmpFile)
+	if codec == "zstd" {
+		if w, err = zstd.NewWriter(tmpFile); err != nil {
+			tmpFile.Close()
+			os.Remove(tmpFile.Name())
+			return "", err
+		}
+	}
+	_, err = io.Copy(w, r)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return "", err
+	}
+	return tmpFile.Name(), nil
+}
+
+// newReader returns a reader of the decompressed data from r.
+func (c compression) newReader(r io.Reader) (io.ReadCloser, error) {
+	if err := checkCompressCodec(c.codec); err != nil {
+		return nil, err
+	}
+	if c.codec == "zstd" {
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	zr.Multistream(false)
+	return zr, nil
+}
+
+// decompress copies the decompressed data from r to w and checks its
+// length.
+func (c compression) decompress(w io.Writer, r io.Reader) error {
+	zr, err := c.newReader(r)
+	if err != nil {
+		return err
+	}
+	if err = c.copyDecompressed(w, zr); err != nil {
+		zr.Close()
+		return err
+	}
+	return zr.Close()
+}
+
+func (c compression) copyDecompressed(w io.Writer, zr io.Reader) error {
+	n, err := io.Copy(w, zr)
+	if err != nil {
+		return err
+	} else if n != c.origLen {
+		return fmt.Errorf("decompressed %d bytes instead of %d", n, c.origLen)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCompressedFilesAreRestored(t *testing.T) {
+	defer func() { compressCodec, encryptInput, passphrase = "", false, nil }()
+	for _, test := range []struct {
+		codec   string
+		encrypt bool
+	}{{"gzip", false}, {"gzip", true}, {"zstd", false}, {"zstd", true}} {
+		original := []byte(strings.Repeat("2021-06-01 12:00:00 INFO Nothing happened.\n", 5000))
+		dataFile, err := ioutil.TempFile("", "pres_test_input_*")
+		if err != nil {
+			t.Fatalf("Error creating tempfile: %s", err.Error())
+		}
+		defer os.Remove(dataFile.Name())
+		_, err = dataFile.Write(original)
+		dataFile.Close()
+		if err != nil {
+			t.Fatalf("Error writing tempfile: %s", err.Error())
+		}
+		compressCodec, encryptInput, passphrase = test.codec, test.encrypt, []byte("secret")
+		createPresFile(dataFile.Name())
+		compressCodec, encryptInput = "", false
+		presFilename := fmt.Sprint(dataFile.Name(), ".pres")
+		defer os.Remove(presFilename)
+
+		result, err := checkPresFile(presFilename)
+		if err != nil {
+			t.Fatalf("Error checking *.pres file: %s", err.Error())
+		}
+		c := result.conf.compression
+		if c.codec != test.codec || c.origLen != int64(len(original)) ||
+			result.conf.dataLen*5 > int64(len(original)) {
+			t.Errorf("Got compression %v and data length %d for %d bytes of input",
+				c, result.conf.dataLen, len(original))
+		}
+		if result.conf.encryption.isEnabled() != test.encrypt {
+			t.Errorf("Encryption is %v instead of %v", result.conf.encryption.isEnabled(), test.encrypt)
+		}
+		if err = damageShard(presFilename, result.conf, 0); err != nil {
+			t.Fatalf("Error damaging shard: %s", err.Error())
+		}
+		if err = os.Chmod(presFilename, 0640); err != nil {
+			t.Fatalf("Error changing mode: %s", err.Error())
+		}
+		outFilename := fmt.Sprint(dataFile.Name(), ".restored")
+		defer os.Remove(outFilename)
+		// The damage is found while the data is decoded.
+		if err = restoreAndDecode(presFilename, outFilename, nil, result.conf, passphrase); err != nil {
+			t.Fatalf("Error restoring: %s", err.Error())
+		}
+		if stat, err := os.Stat(outFilename); err != nil || stat.Mode().Perm() != 0640 {
+			t.Errorf("The restored data does not have the mode of the *.pres file: %v", stat)
+		}
+		restored, err := ioutil.ReadFile(outFilename)
+		if err != nil {
+			t.Fatalf("Error reading restored data: %s", err.Error())
+		}
+		if !bytes.Equal(restored, original) {
+			t.Errorf("The restored data differs from the original")
+		}
+	}
+}
@@ -1,53 +1,80 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
-	"os"
 )
 
+// maxShardCnt is the maximum number of data and parity shards combined,
+// that is supported by the Reed-Solomon encoder.
+const maxShardCnt = 256
+
 type conf struct {
 	version        string
 	dataLen        int64
 	dataShardCnt   uint8
 	parityShardCnt uint8
-	shardCRC32Cs   []string
-}
-
-func writeConf(outputFile *os.File, conf conf) error {
-	_, err := fmt.Fprintf(outputFile, "version=%s\n", conf.version)
-	if err != nil {
-		return err
-	}
-	_, err = fmt.Fprintf(outputFile, "data_len=%d\n", conf.dataLen)
-	if err != nil {
-		return err
-	}
-	_, err = fmt.Fprintf(outputFile, "data_shard_cnt=%d\n", conf.dataShardCnt)
-	if err != nil {
-		return err
-	}
-	_, err = fmt.Fprintf(outputFile, "parity_shard_cnt=%d\n", conf.parityShardCnt)
-	if err != nil {
-		return err
-	}
-	for i, crc32c := range conf.shardCRC32Cs {
-		_, err = fmt.Fprintf(outputFile, "shard_%d_crc32c=%s\n", i+1, crc32c)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	hashAlgorithm  string
+	shardHashes    []string
+	// The following are only stored since version 2.
+	filename string // The name of the original file, without directory.
+	modified int64  // The modification time of the original file.
+	created  int64  // The time when the *.pres file was written.
+	// dataSHA256 is the hex encoded SHA-256 digest of the data. It is
+	// only stored in signed files.
+	dataSHA256  string
+	signature   []byte // The Ed25519 signature of signedMessage().
+	publicKey   []byte // The Ed25519 key, that the signature was made with.
+	keyCheck    []byte // Identifies the key of keyed checksums.
+	encryption  encryption
+	compression compression
+	archive     archive
+	tarIndex    []byte // The encoded index of the members of a tar file.
+	volume      volume
 }
 
-func (c1 conf) seemsOK() bool {
+// seemsOK checks whether the conf is complete and consistent in itself
+// and with the size of the file it was read from.
+func (c1 conf) seemsOK(fileSize int64) bool {
+	shardCnt := c1.shardCnt()
 	if c1.version == "" ||
+		c1.hashAlgorithm == "" ||
 		c1.dataLen <= 0 ||
+		c1.dataLen > fileSize ||
 		c1.dataShardCnt <= 0 ||
 		c1.parityShardCnt <= 0 ||
-		len(c1.shardCRC32Cs) < 2 {
+		shardCnt > maxShardCnt ||
+		len(c1.shardHashes) != shardCnt {
 		return false
 	}
-	return true
+	if c1.encryption.isEnabled() && c1.dataLen != c1.encryption.encryptedLen() {
+		return false
+	}
+	// The index is stored at the end of the data or, if it is compressed,
+	// at the start of the decompressed data:
+	if a := c1.archive; a.isEnabled() && c1.compression.isEnabled() &&
+		(a.indexOffset != 0 || a.indexLen > c1.compression.origLen) {
+		return false
+	} else if a.isEnabled() && !c1.compression.isEnabled() &&
+		(a.indexOffset < 0 || a.indexOffset+a.indexLen != c1.dataLen) {
+		return false
+	}
+	for _, hash := range c1.shardHashes {
+		if hash == "" {
+			return false
+		}
+	}
+	// Every data shard must contain data and the parity shards must fit
+	// into the file behind the data:
+	shardSize := calculateShardSize(c1.dataLen, c1.dataShardCnt)
+	lastDataShardSize := c1.dataLen - int64(c1.dataShardCnt-1)*shardSize
+	parityFits := (fileSize-c1.dataLen)/shardSize >= int64(c1.parityShardCnt)
+	return lastDataShardSize > 0 && parityFits
+}
+
+// shardCnt returns the number of data and parity shards combined.
+func (c1 conf) shardCnt() int {
+	return int(c1.dataShardCnt) + int(c1.parityShardCnt)
 }
 
 func (c1 conf) equals(c2 conf) bool {
@@ -55,13 +82,89 @@ func (c1 conf) equals(c2 conf) bool {
 		c1.dataLen != c2.dataLen ||
 		c1.dataShardCnt != c2.dataShardCnt ||
 		c1.parityShardCnt != c2.parityShardCnt ||
-		len(c1.shardCRC32Cs) != len(c2.shardCRC32Cs) {
+		c1.hashAlgorithm != c2.hashAlgorithm ||
+		len(c1.shardHashes) != len(c2.shardHashes) ||
+		c1.filename != c2.filename ||
+		c1.modified != c2.modified ||
+		c1.created != c2.created ||
+		c1.dataSHA256 != c2.dataSHA256 ||
+		!bytes.Equal(c1.signature, c2.signature) ||
+		!bytes.Equal(c1.publicKey, c2.publicKey) ||
+		!bytes.Equal(c1.keyCheck, c2.keyCheck) ||
+		c1.encryption != c2.encryption ||
+		c1.compression != c2.compression ||
+		c1.archive != c2.archive ||
+		!bytes.Equal(c1.tarIndex, c2.tarIndex) ||
+		c1.volume != c2.volume {
 		return false
 	}
-	for i := range c1.shardCRC32Cs {
-		if c1.shardCRC32Cs[i] != c2.shardCRC32Cs[i] {
+	for i := range c1.shardHashes {
+		if c1.shardHashes[i] != c2.shardHashes[i] {
 			return false
 		}
 	}
 	return true
 }
+
+// differences returns the keys, whose values differ between c1 and c2.
+func (c1 conf) differences(c2 conf) []string {
+	var differences []string
+	if c1.version != c2.version {
+		differences = append(differences, "version")
+	}
+	if c1.dataLen != c2.dataLen {
+		differences = append(differences, "data_len")
+	}
+	if c1.dataShardCnt != c2.dataShardCnt {
+		differences = append(differences, "data_shard_cnt")
+	}
+	if c1.parityShardCnt != c2.parityShardCnt {
+		differences = append(differences, "parity_shard_cnt")
+	}
+	if c1.hashAlgorithm != c2.hashAlgorithm {
+		differences = append(differences, "hash_algorithm")
+	}
+	for i := 0; i < len(c1.shardHashes) || i < len(c2.shardHashes); i += 1 {
+		if i >= len(c1.shardHashes) || i >= len(c2.shardHashes) ||
+			c1.shardHashes[i] != c2.shardHashes[i] {
+			differences = append(differences, fmt.Sprintf("shard_%d_%s", i+1, c1.hashAlgorithm))
+		}
+	}
+	if c1.filename != c2.filename {
+		differences = append(differences, "filename")
+	}
+	if c1.modified != c2.modified {
+		differences = append(differences, "modified")
+	}
+	if c1.created != c2.created {
+		differences = append(differences, "created")
+	}
+	if c1.dataSHA256 != c2.dataSHA256 {
+		differences = append(differences, "data_sha256")
+	}
+	if !bytes.Equal(c1.signature, c2.signature) {
+		differences = append(differences, "signature")
+	}
+	if !bytes.Equal(c1.publicKey, c2.publicKey) {
+		differences = append(differences, "public_key")
+	}
+	if !bytes.Equal(c1.keyCheck, c2.keyCheck) {
+		differences = append(differences, "key_check")
+	}
+	if c1.encryption != c2.encryption {
+		differences = append(differences, "encryption")
+	}
+	if c1.compression != c2.compression {
+		differences = append(differences, "compression")
+	}
+	if c1.archive != c2.archive {
+		differences = append(differences, "archive")
+	}
+	if !bytes.Equal(c1.tarIndex, c2.tarIndex) {
+		differences = append(differences, "tar_index")
+	}
+	if c1.volume != c2.volume {
+		differences = append(differences, "volume")
+	}
+	return differences
+}
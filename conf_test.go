@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func FuzzParseConfs(f *testing.F) {
+	metadata, err := exampleMetadata()
+	if err != nil {
+		f.Fatalf("Error creating example metadata: %s", err.Error())
+	}
+	f.Add(metadata, int64(2000))
+	f.Add(metadata, int64(997))
+	f.Add([]byte(strings.Replace(string(metadata), "shard_1_", "shard_0_", 1)), int64(2000))
+	f.Add([]byte(strings.Replace(string(metadata), "=5\n", "=300\n", -1)), int64(2000))
+	f.Add([]byte("[conf]\nparity_shard_cnt=2\ndata_shard_cnt=5\n"), int64(0))
+	f.Fuzz(func(t *testing.T, metadata []byte, fileSize int64) {
+		confs, err := parseConfs(bytes.NewReader(metadata))
+		if err != nil {
+			t.Fatalf("Error parsing confs: %s", err.Error())
+		}
+		if len(confs) != 3 {
+			t.Fatalf("Got %d confs instead of 3", len(confs))
+		}
+		for _, conf := range confs {
+			if conf.seemsOK(fileSize) {
+				checkConsistency(t, conf, fileSize)
+			}
+		}
+		for _, conf := range getCorrectConfs(confs, fileSize) {
+			checkConsistency(t, conf, fileSize)
+		}
+	})
+}
+
+func FuzzGetCorrectConfs(f *testing.F) {
+	metadata, err := exampleMetadata()
+	if err != nil {
+		f.Fatalf("Error creating example metadata: %s", err.Error())
+	}
+	blocks := strings.SplitAfter(string(metadata), "\n\n")
+	f.Add(blocks[0], blocks[1], blocks[2], int64(2000))
+	f.Add(blocks[0], blocks[1], "", int64(2000))
+	f.Add(blocks[0], blocks[1], blocks[2], int64(1000))
+	f.Fuzz(func(t *testing.T, block0, block1, block2 string, fileSize int64) {
+		confs := make([]conf, 3)
+		for i, block := range []string{block0, block1, block2} {
+			parsed, err := parseConfs(strings.NewReader("[conf]\n" + block))
+			if err != nil {
+				t.Fatalf("Error parsing conf: %s", err.Error())
+			}
+			confs[i] = parsed[0]
+		}
+		correctConfs := getCorrectConfs(confs, fileSize)
+		for _, correctConf := range correctConfs {
+			checkConsistency(t, correctConf, fileSize)
+			matches := 0
+			for _, conf := range confs {
+				if correctConf.equals(conf) {
+					matches += 1
+				}
+			}
+			if matches < 2 {
+				t.Errorf("Accepted a conf that is not backed by a copy")
+			}
+		}
+	})
+}
+
+func TestUnsupportedVersionIsRejected(t *testing.T) {
+	metadata, err := exampleMetadata()
+	if err != nil {
+		t.Fatalf("Error creating example metadata: %s", err.Error())
+	}
+	file, err := ioutil.TempFile("", "pres_test_version_*")
+	if err != nil {
+		t.Fatalf("Error creating tempfile: %s", err.Error())
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	// Data and parity of the example conf need 997+2*200 bytes.
+	content := append(make([]byte, 1397), append([]byte("\n\n"), metadata...)...)
+	content = bytes.Replace(content, []byte("version=1"), []byte("version=2"), -1)
+	if _, err = file.Write(content); err != nil {
+		t.Fatalf("Error writing tempfile: %s", err.Error())
+	}
+	result, err := checkConfs(file.Name())
+	if err == nil {
+		t.Errorf("Version 2 was not rejected")
+	}
+	if result.intactConfCnt != 3 {
+		t.Errorf("Found %d intact conf blocks instead of 3", result.intactConfCnt)
+	}
+}
+
+// checkConsistency asserts that conf can safely be used to read the
+// shards of a file with the given size.
+func checkConsistency(t *testing.T, conf conf, fileSize int64) {
+	shardCnt := conf.shardCnt()
+	if shardCnt > maxShardCnt {
+		t.Fatalf("Accepted conf with %d shards", shardCnt)
+	}
+	if len(conf.shardHashes) != shardCnt {
+		t.Fatalf("Accepted conf with %d checksums for %d shards",
+			len(conf.shardHashes), shardCnt)
+	}
+	for i := 0; i < shardCnt; i += 1 {
+		offset, size := getShardBounds(conf, i)
+		if offset < 0 || size <= 0 || offset+size > fileSize {
+			t.Fatalf("Shard %d at offset %d with size %d does not fit into %d bytes",
+				i+1, offset, size, fileSize)
+		}
+	}
+}
+
+// exampleMetadata returns the metadata from the example in README.md.
+func exampleMetadata() ([]byte, error) {
+	conf := conf{
+		version:        "1",
+		dataLen:        997,
+		dataShardCnt:   5,
+		parityShardCnt: 2,
+	}
+	for i := 0; i < 7; i += 1 {
+		conf.shardHashes = append(conf.shardHashes, fmt.Sprint(360670479+i))
+	}
+	file, err := ioutil.TempFile("", "pres_test_metadata_*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	for _, header := range []string{"[conf]", "\n[conf_copy_1]", "\n[conf_copy_2]"} {
+		if _, err = fmt.Fprintln(file, header); err != nil {
+			return nil, err
+		}
+		if err = writeConf(file, conf); err != nil {
+			return nil, err
+		}
+	}
+	return ioutil.ReadFile(file.Name())
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// setting is a default, that can be changed in the config file and with
+// an environment variable. Command line options override both, because
+// the flags are defined with the changed defaults.
+type setting struct {
+	key    string // The key in the config file.
+	usage  string
+	set    func(value string) error
+	get    func() string
+	source string // Where the value came from, for 'pres config show'.
+}
+
+var settings = []*setting{
+	{key: "data_shards", usage: "number of data shards of new files",
+		set: func(v string) error { return parseShardCnt(v, &dataShardCnt) },
+		get: func() string { return strconv.Itoa(int(dataShardCnt)) }},
+	{key: "parity_shards", usage: "number of parity shards of new files",
+		set: func(v string) error { return parseShardCnt(v, &parityShardCnt) },
+		get: func() string { return strconv.Itoa(int(parityShardCnt)) }},
+	{key: "hash", usage: "checksum algorithm of new files; empty for crc32c, or hmac-sha256 with a key",
+		set: func(v string) error {
+			if v != "" && hashAlgorithms[v] == nil {
+				return fmt.Errorf("unsupported hash algorithm '%s'", v)
+			}
+			configHashAlgorithm = v
+			return nil
+		},
+		get: func() string { return configHashAlgorithm }},
+	{key: "format", usage: "format version of new files; empty for " + currentVersion + ", or 2 if needed",
+		set: func(v string) error {
+			if _, err := getFormat(v); v != "" && err != nil {
+				return err
+			}
+			configFormatVersion = v
+			return nil
+		},
+		get: func() string { return configFormatVersion }},
+	{key: "jobs", usage: "number of shards to hash concurrently",
+		set: func(v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid number of jobs '%s'", v)
+			}
+			workerCnt = n
+			return nil
+		},
+		get: func() string { return strconv.Itoa(workerCnt) }},
+	{key: "tmpdir", usage: "directory for temporary files, like the parity files of create",
+		set: func(v string) error {
+			tmpDirname = v
+			return nil
+		},
+		get: func() string {
+			if tmpDirname == "" {
+				return os.TempDir()
+			}
+			return tmpDirname
+		}},
+	{key: "output", usage: "output format of verify: text or json",
+		set: func(v string) error {
+			if v != "text" && v != "json" {
+				return fmt.Errorf("invalid output format '%s'", v)
+			}
+			jsonOutput = v == "json"
+			return nil
+		},
+		get: func() string {
+			if jsonOutput {
+				return "json"
+			}
+			return "text"
+		}},
+}
+
+// configHashAlgorithm and configFormatVersion are the hash and format
+// settings. Unlike -hash and -format, they only apply to new files, so
+// that upgrade keeps the checksums and format of the upgraded file.
+var configHashAlgorithm, configFormatVersion string
+
+func parseShardCnt(v string, cnt *uint8) error {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n >= maxShardCnt {
+		return fmt.Errorf("invalid number of shards '%s'", v)
+	}
+	*cnt = uint8(n)
+	return nil
+}
+
+// getConfigFilename returns the name of the config file, which does not
+// need to exist.
+func getConfigFilename() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".config")
+	}
+	return filepath.Join(dir, "pres", "config")
+}
+
+// getSettingEnv returns the name of the environment variable of s, e.g.
+// PRES_DATA_SHARDS.
+func getSettingEnv(s *setting) string {
+	return "PRES_" + strings.ToUpper(s.key)
+}
+
+// loadSettings applies the config file and then the environment
+// variables to the defaults.
+func loadSettings() error {
+	for _, s := range settings {
+		s.source = "default"
+	}
+	configFilename := getConfigFilename()
+	if err := loadConfigFile(configFilename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, s := range settings {
+		env := getSettingEnv(s)
+		if v, ok := os.LookupEnv(env); ok {
+			if err := s.set(v); err != nil {
+				return fmt.Errorf("%s: %s", env, err.Error())
+			}
+			s.source = env
+		}
+	}
+	return nil
+}
+
+// loadConfigFile reads key=value lines from filename. Empty lines and
+// lines starting with # are ignored.
+func loadConfigFile(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber += 1 {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			return fmt.Errorf("%s:%d: missing '='", filename, lineNumber)
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		s := getSetting(key)
+		if s == nil {
+			return fmt.Errorf("%s:%d: unknown key '%s'", filename, lineNumber, key)
+		}
+		if err = s.set(value); err != nil {
+			return fmt.Errorf("%s:%d: %s", filename, lineNumber, err.Error())
+		}
+		s.source = filename
+	}
+	return scanner.Err()
+}
+
+func getSetting(key string) *setting {
+	for _, s := range settings {
+		if s.key == key {
+			return s
+		}
+	}
+	return nil
+}
+
+// runConfigCommand runs 'pres config show', which prints the settings,
+// that are in effect without command line options, in the format of
+// the config file.
+func runConfigCommand(subcommand string) {
+	if subcommand != "show" {
+		fmt.Fprintln(os.Stderr, "Unknown config command; use 'pres config show'.")
+		os.Exit(1)
+	}
+	fmt.Printf("# Config file: %s\n", getConfigFilename())
+	for _, s := range settings {
+		fmt.Printf("# %s; from %s\n", s.usage, s.source)
+		fmt.Printf("%s=%s\n", s.key, s.get())
+	}
+}
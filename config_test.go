@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pres_test_config_*")
+	if err != nil {
+		t.Fatalf("Error creating temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "pres"), 0755)
+	config := "# Defaults of this host\nparity_shards = 10\n\njobs=3\noutput=json\n"
+	if err = ioutil.WriteFile(filepath.Join(dir, "pres", "config"), []byte(config), 0644); err != nil {
+		t.Fatalf("Error writing config: %s", err.Error())
+	}
+	defaultParityShardCnt, defaultWorkerCnt := parityShardCnt, workerCnt
+	defaultConfigHome := os.Getenv("XDG_CONFIG_HOME")
+	defer func() {
+		parityShardCnt, workerCnt, jsonOutput = defaultParityShardCnt, defaultWorkerCnt, false
+		os.Setenv("XDG_CONFIG_HOME", defaultConfigHome)
+		os.Unsetenv("PRES_JOBS")
+	}()
+	os.Setenv("XDG_CONFIG_HOME", dir)
+	os.Setenv("PRES_JOBS", "5")
+	if err = loadSettings(); err != nil {
+		t.Fatalf("Error loading settings: %s", err.Error())
+	}
+	if parityShardCnt != 10 || workerCnt != 5 || !jsonOutput {
+		t.Errorf("Got parity_shards=%d, jobs=%d, json=%v instead of 10, 5, true",
+			parityShardCnt, workerCnt, jsonOutput)
+	}
+
+	for _, config := range []string{"jobs", "jobs=0", "unknown=1", "data_shards=256"} {
+		ioutil.WriteFile(filepath.Join(dir, "pres", "config"), []byte(config), 0644)
+		if err = loadSettings(); err == nil {
+			t.Errorf("Invalid config '%s' was accepted", config)
+		}
+	}
+}
+
+func TestHashSettingDoesNotChangeUpgrade(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pres_test_config_*")
+	if err != nil {
+		t.Fatalf("Error creating temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	dataFilename, err := createTestInputWithSize(12345)
+	if err != nil {
+		t.Fatalf("Error creating tempfile: %s", err.Error())
+	}
+	createPresFile(dataFilename)
+	presFilename := fmt.Sprint(dataFilename, ".pres")
+	defer os.Remove(presFilename)
+
+	defaultConfigHome := os.Getenv("XDG_CONFIG_HOME")
+	defer func() {
+		configHashAlgorithm, configFormatVersion = "", ""
+		os.Setenv("XDG_CONFIG_HOME", defaultConfigHome)
+	}()
+	os.Setenv("XDG_CONFIG_HOME", dir)
+	os.Mkdir(filepath.Join(dir, "pres"), 0755)
+	config := "hash=sha256\nformat=2\n"
+	if err = ioutil.WriteFile(filepath.Join(dir, "pres", "config"), []byte(config), 0644); err != nil {
+		t.Fatalf("Error writing config: %s", err.Error())
+	}
+	if err = loadSettings(); err != nil {
+		t.Fatalf("Error loading settings: %s", err.Error())
+	}
+	upgradePresFile(presFilename)
+	result, err := checkConfs(presFilename)
+	if err != nil {
+		t.Fatalf("Error checking *.pres file: %s", err.Error())
+	}
+	if result.conf.hashAlgorithm != defaultHashAlgorithm || result.conf.version != currentVersion {
+		t.Errorf("Upgrade changed the file to version %s with %s checksums",
+			result.conf.version, result.conf.hashAlgorithm)
+	}
+}
+
+func TestTmpdirSettingIsUsed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pres_test_config_*")
+	if err != nil {
+		t.Fatalf("Error creating temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defaultConfigHome := os.Getenv("XDG_CONFIG_HOME")
+	defer func() {
+		tmpDirname = ""
+		os.Setenv("XDG_CONFIG_HOME", defaultConfigHome)
+		os.Unsetenv("PRES_TMPDIR")
+	}()
+	os.Setenv("XDG_CONFIG_HOME", dir)
+	os.Setenv("PRES_TMPDIR", dir)
+	if err = loadSettings(); err != nil {
+		t.Fatalf("Error loading settings: %s", err.Error())
+	}
+	tmpFile, err := createTempFile("", "pres_test_tmpdir_*")
+	if err != nil {
+		t.Fatalf("Error creating temporary file: %s", err.Error())
+	}
+	tmpFile.Close()
+	if filepath.Dir(tmpFile.Name()) != dir {
+		t.Errorf("Temporary file '%s' was not created in '%s'", tmpFile.Name(), dir)
+	}
+}
@@ -4,32 +4,131 @@ import (
 	"fmt"
 	"github.com/klauspost/reedsolomon"
 	"hash"
-	"hash/crc32"
 	"io"
-	"io/ioutil"
 	"os"
+	"path/filepath"
+	"time"
 )
 
 func createPresFile(inFilename string) {
-	presFilename := fmt.Sprint(inFilename, ".pres")
+	presFilename := getPresFilename(inFilename)
 	if _, err := os.Stat(presFilename); !os.IsNotExist(err) {
 		fmt.Fprintf(os.Stderr, "'%s' already exists.\n", presFilename)
 		os.Exit(1)
 	}
-	var conf conf
-	conf.dataShardCnt = 100
-	conf.parityShardCnt = 3
-	var err error
-	conf.dataLen, err = getFilesize(inFilename)
+	stat, err := os.Stat(inFilename)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Error checking input filesize:", err.Error())
 		os.Exit(1)
 	}
-	if conf.dataLen == 0 {
+	if archiveDirname != "" && !stat.IsDir() {
+		fmt.Fprintf(os.Stderr, "'%s' is no directory.\n", inFilename)
+		os.Exit(1)
+	} else if archiveDirname == "" && stat.IsDir() {
+		fmt.Fprintf(os.Stderr, "'%s' is a directory; use -a to protect it.\n", inFilename)
+		os.Exit(1)
+	} else if archiveDirname == "" && stat.Size() == 0 {
 		fmt.Fprintln(os.Stderr, "The input file is empty.")
 		os.Exit(1)
 	}
+	var conf conf
+	conf.dataLen = stat.Size()
+	conf.dataShardCnt = dataShardCnt
+	conf.parityShardCnt = parityShardCnt
+	// The size of a directory says nothing about the size of its archive,
+	// which is only known after archiving:
+	if archiveDirname == "" {
+		conf.dataShardCnt = reduceShardCntIfNecessary(conf)
+	}
+	conf.hashAlgorithm = defaultHashAlgorithm
+	if hashAlgorithm != "" {
+		conf.hashAlgorithm = hashAlgorithm
+	}
+	conf.filename = filepath.Base(inFilename)
+	conf.modified = stat.ModTime().UnixNano()
+	conf.created = time.Now().UnixNano()
+	if tarMode {
+		fmt.Fprintf(os.Stderr, "Indexing the members of '%s'.\n", inFilename)
+		if conf.tarIndex, err = indexTar(inFilename); err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading tar file:", err.Error())
+			os.Exit(2)
+		}
+	}
+	payloadFilename := inFilename
+	mode := stat.Mode()
+	// Only the last temporary file becomes the *.pres file, so the others
+	// can be created in the directory of the tmpdir setting:
+	getPayloadDir := func(isLast bool) string {
+		if isLast {
+			return filepath.Dir(presFilename)
+		}
+		return ""
+	}
+	if archiveDirname != "" {
+		fmt.Fprintf(os.Stderr, "Archiving '%s'.\n", inFilename)
+		payloadDir := getPayloadDir(compressCodec == "" && !encryptInput)
+		payloadFilename, conf.archive, err = createArchiveFile(inFilename, payloadDir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error archiving input:", err.Error())
+			os.Exit(2)
+		}
+		defer os.Remove(payloadFilename)
+		conf.dataLen = conf.archive.indexOffset + conf.archive.indexLen
+		mode = 0644
+	}
+	if compressCodec != "" {
+		fmt.Fprintf(os.Stderr, "Compressing '%s'.\n", inFilename)
+		conf.compression = compression{compressCodec, conf.dataLen}
+		payloadFilename, conf.archive, err = compressPayload(payloadFilename, getPayloadDir(!encryptInput), conf)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error compressing input:", err.Error())
+			os.Exit(2)
+		}
+		defer os.Remove(payloadFilename)
+		if conf.dataLen, err = getFilesize(payloadFilename); err != nil {
+			fmt.Fprintln(os.Stderr, "Error checking compressed filesize:", err.Error())
+			os.Exit(2)
+		}
+	}
+	if encryptInput {
+		if conf.encryption, err = newEncryption(conf.dataLen); err != nil {
+			fmt.Fprintln(os.Stderr, "Error preparing encryption:", err.Error())
+			os.Exit(2)
+		}
+		conf.dataLen = conf.encryption.encryptedLen()
+	}
 	conf.dataShardCnt = reduceShardCntIfNecessary(conf)
+	resetSignature(&conf)
+	if conf.version, err = chooseVersion(conf, currentVersion); err != nil {
+		fmt.Fprintln(os.Stderr, "Error choosing the format:", err.Error())
+		os.Exit(1)
+	}
+	// Nothing must be written, if the volumes cannot be created:
+	if volumeSize > 0 {
+		if err = chooseVolumeLayout(&conf); err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid volume size:", err.Error())
+			if payloadFilename != inFilename {
+				os.Remove(payloadFilename)
+			}
+			os.Exit(1)
+		}
+	}
+	if conf.encryption.isEnabled() {
+		encryptedFilename, err := encryptToTempFile(payloadFilename, getPayloadDir(true), &conf.encryption)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error encrypting input:", err.Error())
+			os.Exit(2)
+		}
+		defer os.Remove(encryptedFilename)
+		payloadFilename = encryptedFilename
+	}
+	if payloadFilename != inFilename {
+		if err = createFromTempFile(payloadFilename, presFilename, mode, conf); err != nil {
+			fmt.Fprintln(os.Stderr, "Error creating *.pres file:", err.Error())
+			os.Exit(3)
+		}
+		return
+	}
 
 	hashers := getShardsHashers(conf)
 	fmt.Fprintln(os.Stderr, "Calculating parity information and checksums.")
@@ -59,6 +158,53 @@ func createPresFile(inFilename string) {
 	}
 }
 
+// compressPayload compresses payloadFilename to a new temporary file in
+// dir and returns its name. Compressed data can only be read from the
+// start, so the index of an archive is moved in front of its contents;
+// the returned archive describes the new layout.
+func compressPayload(payloadFilename, dir string, conf conf) (string, archive, error) {
+	file, err := os.Open(payloadFilename)
+	if err != nil {
+		return "", archive{}, err
+	}
+	defer file.Close()
+	var r io.Reader = file
+	a := conf.archive
+	if a.isEnabled() {
+		if r, a, err = moveArchiveIndexToFront(file, a); err != nil {
+			return "", archive{}, err
+		}
+	}
+	filename, err := compressToTempFile(r, dir, conf.compression.codec)
+	return filename, a, err
+}
+
+func getPresFilename(inFilename string) string {
+	if outFilename != "" {
+		return outFilename
+	} else if archiveDirname != "" {
+		return fmt.Sprint(filepath.Clean(inFilename), ".pres")
+	}
+	return fmt.Sprint(inFilename, ".pres")
+}
+
+// createFromTempFile protects tmpFilename, which contains the archived,
+// compressed or encrypted data, and renames it to presFilename. Unlike
+// the input file, that is kept.
+func createFromTempFile(tmpFilename, presFilename string, mode os.FileMode, conf conf) error {
+	if err := protectFile(tmpFilename, conf); err != nil {
+		return err
+	}
+	if err := syncFile(tmpFilename); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpFilename, mode); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Writing '%s'.\n", presFilename)
+	return os.Rename(tmpFilename, presFilename)
+}
+
 // reduceShardCntIfNecessary returns a reduced dataShardCnt, if the
 // input file is too small for the previously set dataShardCnt.
 func reduceShardCntIfNecessary(conf conf) uint8 {
@@ -66,23 +212,21 @@ func reduceShardCntIfNecessary(conf conf) uint8 {
 	return uint8((conf.dataLen + shardSize - 1) / shardSize)
 }
 
-func getShardsHashers(conf conf) []hash.Hash32 {
-	hashers := make([]hash.Hash32, conf.dataShardCnt+conf.parityShardCnt)
-	for i := 0; i < int(conf.dataShardCnt+conf.parityShardCnt); i += 1 {
-		hashers[i] = crc32.New(crc32.MakeTable(crc32.Castagnoli))
+func getShardsHashers(conf conf) []hash.Hash {
+	hashers := make([]hash.Hash, conf.shardCnt())
+	for i := 0; i < conf.shardCnt(); i += 1 {
+		hashers[i] = hashAlgorithms[conf.hashAlgorithm]()
 	}
 	return hashers
 }
 
-func makeParityFilesAndCalculateHashes(inFilename string, conf conf, hashers []hash.Hash32) ([]string, error) {
-	dataInputs, err := getDataInputs(inFilename, conf.dataShardCnt)
-	if err != nil {
-		return nil, err
-	}
-	dataInputReaders, err := toDataInputReaders(dataInputs, conf.dataShardCnt, hashers)
+func makeParityFilesAndCalculateHashes(inFilename string, conf conf, hashers []hash.Hash) ([]string, error) {
+	inFile, err := os.Open(inFilename)
 	if err != nil {
 		return nil, err
 	}
+	defer inFile.Close()
+	dataInputReaders := toDataInputReaders(inFile, conf, hashers)
 	parityOutputs, err := getParityOutputs(conf.parityShardCnt)
 	if err != nil {
 		return nil, err
@@ -92,12 +236,6 @@ func makeParityFilesAndCalculateHashes(inFilename string, conf conf, hashers []h
 	if err != nil {
 		return nil, err
 	}
-	for i := range dataInputs {
-		err = dataInputs[i].Close()
-		if err != nil {
-			return nil, err
-		}
-	}
 	parityFilenames := make([]string, conf.parityShardCnt)
 	for i, parityOutput := range parityOutputs {
 		parityFilenames[i] = parityOutput.Name()
@@ -128,82 +266,50 @@ func copyOverData(destFilename string, srcFilenames ...string) error {
 	return nil
 }
 
-func writeMetadata(inFilename string, conf conf, hashers []hash.Hash32) error {
+func writeMetadata(inFilename string, conf conf, hashers []hash.Hash) error {
 	destFile, err := os.OpenFile(inFilename, os.O_APPEND|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
 	defer destFile.Close()
-	shardsHashes := make([]string, conf.dataShardCnt+conf.parityShardCnt)
+	shardsHashes := make([]string, conf.shardCnt())
 	for i := range hashers {
-		shardsHashes[i] = fmt.Sprint(hashers[i].Sum32())
+		shardsHashes[i] = formatSum(conf.hashAlgorithm, hashers[i].Sum(nil))
 	}
-	conf.version = "1"
-	conf.shardCRC32Cs = shardsHashes
-	if _, err := fmt.Fprintln(destFile, "\n\n[conf]"); err != nil {
-		return err
+	conf.shardHashes = shardsHashes
+	conf.keyCheck = nil
+	if isKeyed(conf.hashAlgorithm) {
+		conf.keyCheck = getKeyCheck()
 	}
-	if err = writeConf(destFile, conf); err != nil {
-		return err
-	}
-	if _, err := fmt.Fprintln(destFile, "\n[conf_copy_1]"); err != nil {
-		return err
-	}
-	if err = writeConf(destFile, conf); err != nil {
-		return err
+	// A present signature is kept; it is still valid, if a damaged file
+	// is rewritten with the same data and conf.
+	if conf.publicKey != nil && conf.signature == nil {
+		if err = sign(inFilename, &conf); err != nil {
+			return err
+		}
 	}
-	if _, err := fmt.Fprintln(destFile, "\n[conf_copy_2]"); err != nil {
+	format, err := getFormat(conf.version)
+	if err != nil {
 		return err
 	}
-	return writeConf(destFile, conf)
+	return format.writeMetadata(destFile, conf)
 }
 
-func getDataInputs(inFilename string, dataShardCnt uint8) ([]*os.File, error) {
-	var err error
-	var shardSize int64
-	inputs := make([]*os.File, dataShardCnt)
-	for i := range inputs {
-		if inputs[i], err = os.Open(inFilename); err != nil {
-			return nil, err
-		}
-		if _, err = inputs[i].Seek(int64(i)*shardSize, 0); err != nil {
-			return nil, err
-		}
-		if i == 0 {
-			shardSize, err = getShardSize(inputs[0], dataShardCnt)
-			if err != nil {
-				return nil, err
-			}
-		}
-	}
-	return inputs, nil
-}
-
-func toDataInputReaders(dataInputs []*os.File, dataShardCnt uint8, shardHashers []hash.Hash32) ([]io.Reader, error) {
-	shardSize, err := getShardSize(dataInputs[0], dataShardCnt)
-	if err != nil {
-		return nil, err
-	}
-	dataLen, err := getDataLen(dataInputs[0])
-	if err != nil {
-		return nil, err
-	}
-	inputReaders := make([]io.Reader, dataShardCnt)
-	for i := range dataInputs {
-		inputReaders[i] = dataInputs[i]
-		inputReaders[i] = io.LimitReader(inputReaders[i], shardSize)
+func toDataInputReaders(inFile io.ReaderAt, conf conf, shardHashers []hash.Hash) []io.Reader {
+	inputReaders := newShardReaders(inFile, conf, int(conf.dataShardCnt))
+	for i := range inputReaders {
 		inputReaders[i] = io.TeeReader(inputReaders[i], shardHashers[i])
 	}
-	i := dataShardCnt - 1
-	inputReaders[i] = fillLastDataReader(inputReaders[i], dataShardCnt, dataLen)
-	return inputReaders, nil
+	i := conf.dataShardCnt - 1
+	inputReaders[i] = fillLastDataReader(inputReaders[i], conf.dataShardCnt, conf.dataLen)
+	return inputReaders
 }
 
 func getParityOutputs(parityShardCnt uint8) ([]*os.File, error) {
 	var err error
 	outputs := make([]*os.File, parityShardCnt)
 	for i := range outputs {
-		outputs[i], err = ioutil.TempFile("", "pres_parity_file_*")
+		outputs[i], err = createTempFile("", "pres_parity_file_*")
 		if err != nil {
 			return nil, err
 		}
@@ -211,7 +317,7 @@ func getParityOutputs(parityShardCnt uint8) ([]*os.File, error) {
 	return outputs, nil
 }
 
-func getParityOutputWriters(outputs []*os.File, conf conf, shardHashers []hash.Hash32) []io.Writer {
+func getParityOutputWriters(outputs []*os.File, conf conf, shardHashers []hash.Hash) []io.Writer {
 	writers := make([]io.Writer, conf.parityShardCnt)
 	for i := range outputs {
 		writers[i] = outputs[i]
@@ -222,7 +328,11 @@ func getParityOutputWriters(outputs []*os.File, conf conf, shardHashers []hash.H
 }
 
 func writeParityFiles(dataInputReaders []io.Reader, conf conf, parityOutputWriters []io.Writer) error {
-	enc, err := reedsolomon.NewStream(int(conf.dataShardCnt), int(conf.parityShardCnt))
+	// Small files don't need buffers of readAheadSize for every shard:
+	shardSize := calculateShardSize(conf.dataLen, conf.dataShardCnt)
+	blockSize := int(min64(shardSize, readAheadSize))
+	enc, err := reedsolomon.NewStream(int(conf.dataShardCnt), int(conf.parityShardCnt),
+		reedsolomon.WithStreamBlockSize(blockSize))
 	if err != nil {
 		return err
 	}
@@ -230,14 +340,6 @@ func writeParityFiles(dataInputReaders []io.Reader, conf conf, parityOutputWrite
 	return err
 }
 
-func getShardSize(input *os.File, dataShardCnt uint8) (int64, error) {
-	fileSize, err := getDataLen(input)
-	if err != nil {
-		return -1, err
-	}
-	return calculateShardSize(fileSize, dataShardCnt), nil
-}
-
 func getFilesize(filename string) (int64, error) {
 	file, err := os.Open(filename)
 	if err != nil {
@@ -47,8 +47,237 @@ func TestCreateDamageVerifyRestore(t *testing.T) {
 	}
 }
 
+type damageScenario struct {
+	name string
+	// shards returns the indices of the shards to damage.
+	shards func(conf conf) []int
+	// confCopies are the indices of the copies of the conf to damage.
+	confCopies        []int
+	wantIntactConfCnt int
+	wantRestorable    bool
+}
+
+var damageScenarios = []damageScenario{
+	{
+		name:              "intact",
+		shards:            func(conf conf) []int { return nil },
+		wantIntactConfCnt: 3,
+		wantRestorable:    true,
+	},
+	{
+		name:              "first data shard",
+		shards:            func(conf conf) []int { return []int{0} },
+		wantIntactConfCnt: 3,
+		wantRestorable:    true,
+	},
+	{
+		name: "last data shard",
+		shards: func(conf conf) []int {
+			return []int{int(conf.dataShardCnt) - 1}
+		},
+		wantIntactConfCnt: 3,
+		wantRestorable:    true,
+	},
+	{
+		name: "first parity shard",
+		shards: func(conf conf) []int {
+			return []int{int(conf.dataShardCnt)}
+		},
+		wantIntactConfCnt: 3,
+		wantRestorable:    true,
+	},
+	{
+		name: "last parity shard",
+		shards: func(conf conf) []int {
+			return []int{conf.shardCnt() - 1}
+		},
+		wantIntactConfCnt: 3,
+		wantRestorable:    true,
+	},
+	{
+		name: "shards up to the parity limit",
+		shards: func(conf conf) []int {
+			return spreadShards(conf, int(conf.parityShardCnt))
+		},
+		wantIntactConfCnt: 3,
+		wantRestorable:    true,
+	},
+	{
+		name: "shards beyond the parity limit",
+		shards: func(conf conf) []int {
+			return spreadShards(conf, int(conf.parityShardCnt)+1)
+		},
+		wantIntactConfCnt: 3,
+		wantRestorable:    false,
+	},
+	{
+		name:              "one conf block",
+		shards:            func(conf conf) []int { return nil },
+		confCopies:        []int{1},
+		wantIntactConfCnt: 2,
+		wantRestorable:    true,
+	},
+	{
+		name: "one conf block and shards up to the parity limit",
+		shards: func(conf conf) []int {
+			return spreadShards(conf, int(conf.parityShardCnt))
+		},
+		confCopies:        []int{0},
+		wantIntactConfCnt: 2,
+		wantRestorable:    true,
+	},
+	{
+		name:              "two conf blocks",
+		shards:            func(conf conf) []int { return nil },
+		confCopies:        []int{0, 2},
+		wantIntactConfCnt: 0,
+		wantRestorable:    false,
+	},
+}
+
+// TestDamageScenarios damages *.pres files of different sizes and
+// formats in specific ways and checks that verification finds exactly the inflicted
+// damage and that restoration succeeds exactly when possible.
+func TestDamageScenarios(t *testing.T) {
+	// 100 bytes yield shards of one byte, 101 and 199 bytes a short last
+	// data shard and 150 bytes a reduced number of data shards.
+	defer func() { formatVersion = "" }()
+	for _, formatVersion = range []string{"1", "2"} {
+		for _, size := range []int{1, 2, 99, 100, 101, 150, 199, 1000, 32123} {
+			for _, scenario := range damageScenarios {
+				name := fmt.Sprintf("version %s/%d bytes/%s", formatVersion, size, scenario.name)
+				t.Run(name, func(t *testing.T) {
+					testDamageScenario(t, size, scenario)
+				})
+			}
+		}
+	}
+}
+
+func testDamageScenario(t *testing.T, size int, scenario damageScenario) {
+	dataFilename, err := createTestInputWithSize(size)
+	if err != nil {
+		t.Fatalf("Error creating tempfile: %s", err.Error())
+	}
+	origFilename := fmt.Sprint(dataFilename, ".orig")
+	defer os.Remove(origFilename)
+	if err = copyFile(dataFilename, origFilename); err != nil {
+		t.Fatalf("Error copying file: %s", err.Error())
+	}
+	createPresFile(dataFilename)
+	presFilename := fmt.Sprint(dataFilename, ".pres")
+	defer os.Remove(presFilename)
+	conf, err := getConf(presFilename)
+	if err != nil {
+		t.Fatalf("Error reading conf of new file: %s", err.Error())
+	}
+
+	damagedShards := scenario.shards(conf)
+	for _, i := range damagedShards {
+		if err = damageShard(presFilename, conf, i); err != nil {
+			t.Fatalf("Error damaging shard: %s", err.Error())
+		}
+	}
+	for _, i := range scenario.confCopies {
+		if err = damageConf(presFilename, i); err != nil {
+			t.Fatalf("Error damaging conf block: %s", err.Error())
+		}
+	}
+
+	result, err := checkPresFile(presFilename)
+	if err != nil {
+		t.Fatalf("Error checking *.pres file: %s", err.Error())
+	}
+	if result.intactConfCnt != scenario.wantIntactConfCnt {
+		t.Errorf("Found %d intact conf blocks instead of %d",
+			result.intactConfCnt, scenario.wantIntactConfCnt)
+	}
+	if result.intactConfCnt > 0 &&
+		fmt.Sprint(result.damagedShards()) != fmt.Sprint(damagedShards) {
+		t.Errorf("Found damaged shards %v instead of %v",
+			result.damagedShards(), damagedShards)
+	}
+	if result.restorable() != scenario.wantRestorable {
+		t.Errorf("Restorable is %v instead of %v",
+			result.restorable(), scenario.wantRestorable)
+	}
+	if result.intactConfCnt == 0 {
+		return
+	}
+
+	err = restore(presFilename, dataFilename, result.shardStates, result.conf)
+	defer os.Remove(dataFilename)
+	if !scenario.wantRestorable {
+		if err == nil {
+			t.Errorf("Restoring succeeded, although it should be impossible")
+		}
+		if _, statErr := os.Stat(dataFilename); !os.IsNotExist(statErr) {
+			t.Errorf("Failed restoration left '%s' behind", dataFilename)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("Error restoring: %s", err.Error())
+	}
+	eq, err := filesAreEqual(origFilename, dataFilename)
+	if err != nil {
+		t.Fatalf("Error comparing files: %s", err.Error())
+	}
+	if !eq {
+		t.Errorf("Restored data does not match the original")
+	}
+}
+
+// spreadShards returns the indices of cnt shards, that are spread evenly
+// across all shards, including the first and last one.
+func spreadShards(conf conf, cnt int) []int {
+	shardCnt := conf.shardCnt()
+	shards := make([]int, cnt)
+	for i := range shards {
+		shards[i] = i * (shardCnt - 1) / (cnt - 1)
+	}
+	return shards
+}
+
+// damageShard inverts the middle byte of the i-th shard.
+func damageShard(filename string, conf conf, i int) error {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	offset, size := getShardBounds(conf, i)
+	content[offset+size/2] ^= 0xff
+	return ioutil.WriteFile(filename, content, 0644)
+}
+
+// damageConf damages the i-th copy of the conf. In text conf blocks,
+// the first digit of the data_len is replaced by a letter, so that
+// identically damaged copies do not match; otherwise the middle byte of
+// the copy is inverted.
+func damageConf(filename string, i int) error {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	offset, size, err := findConf(filename, int64(len(content)), i)
+	if err != nil {
+		return err
+	}
+	block := content[offset : offset+size]
+	prefix := []byte("data_len=")
+	if j := bytes.Index(block, prefix); j >= 0 {
+		block[j+len(prefix)] = 'x'
+	} else {
+		block[size/2] ^= 0xff
+	}
+	return ioutil.WriteFile(filename, content, 0644)
+}
+
 func createTestInput() (string, error) {
-	fileSize := 1 + rand.Int()%32e3
+	return createTestInputWithSize(1 + rand.Int()%32e3)
+}
+
+func createTestInputWithSize(fileSize int) (string, error) {
 	content := make([]byte, fileSize)
 	_, err := rand.Read(content)
 	if err != nil {
@@ -79,18 +308,10 @@ func copyFile(afn, bfn string) error {
 }
 
 func damageOneByte(filename string) error {
-	content, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return err
-	}
-	damageIndex := rand.Int() % len(content)
-	damageByte := make([]byte, 1)
-	_, err = rand.Read(damageByte)
-	if err != nil {
-		return err
-	}
-	content[damageIndex] = damageByte[0]
-	return ioutil.WriteFile(filename, content, 0644)
+	opts := damageOptions{bitCnt: 1, confCopy: -1}
+	random := rand.New(rand.NewSource(rand.Int63()))
+	_, err := damage(filename, filename, opts, random)
+	return err
 }
 
 func filesAreEqual(a, b string) (bool, error) {
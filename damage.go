@@ -0,0 +1,306 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// damageOptions describe the damage, that the damage command inflicts.
+// Offsets refer to the undamaged file. Bit flips and zeroing are done
+// first, then bytes are inserted and finally the file is truncated.
+type damageOptions struct {
+	bitCnt      int
+	shard       int // The number of the shard to damage, starting at 1.
+	confCopy    int // The index of the conf block to damage or -1.
+	zeroRange   string
+	insertRange string
+	truncateCnt int64
+	inPlace     bool
+	outFilename string
+	seed        int64 // If 0, a seed is chosen based on the current time.
+}
+
+var damageOpts = damageOptions{confCopy: -1}
+
+// damagePresFile damages a copy of inFilename, or inFilename itself, to
+// rehearse verification and restoration. It is not intended for regular
+// use and therefore not mentioned in the usage.
+func damagePresFile(inFilename string) {
+	outFilename := damageOpts.outFilename
+	if damageOpts.inPlace {
+		outFilename = inFilename
+	} else if outFilename == "" {
+		outFilename = getDamagedFilename(inFilename)
+	}
+	if !damageOpts.inPlace {
+		if _, err := os.Stat(outFilename); !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "'%s' already exists.\n", outFilename)
+			os.Exit(1)
+		}
+	}
+	if damageOpts.seed == 0 {
+		damageOpts.seed = time.Now().UnixNano()
+	}
+	fmt.Fprintf(os.Stderr, "Damaging '%s' with random seed %d.\n",
+		outFilename, damageOpts.seed)
+	random := rand.New(rand.NewSource(damageOpts.seed))
+	changes, err := damage(inFilename, outFilename, damageOpts, random)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error damaging file:", err.Error())
+		os.Exit(2)
+	}
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+}
+
+func getDamagedFilename(inFilename string) string {
+	return fmt.Sprint(strings.TrimSuffix(inFilename, ".pres"), ".damaged.pres")
+}
+
+// damage writes a damaged version of inFilename to outFilename and
+// returns descriptions of all changes. The two filenames may be equal.
+func damage(inFilename, outFilename string, opts damageOptions, random *rand.Rand) ([]string, error) {
+	fileSize, err := getFilesize(inFilename)
+	if err != nil {
+		return nil, err
+	}
+	regions, err := getDamageRegions(inFilename, fileSize, opts)
+	if err != nil {
+		return nil, err
+	}
+	// If no conf is intact, changes are described without shard numbers.
+	conf, confErr := getConf(inFilename)
+	describe := func(offset int64) string {
+		return describeOffset(conf, confErr == nil, offset)
+	}
+	tmpFile, err := createTempFile(filepath.Dir(outFilename), ".pres_damage_*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+	inFile, err := os.Open(inFilename)
+	if err != nil {
+		return nil, err
+	}
+	defer inFile.Close()
+
+	var changes []string
+	if opts.insertRange == "" {
+		_, err = io.Copy(tmpFile, inFile)
+	} else {
+		var change string
+		change, err = copyWithInsertion(tmpFile, inFile, fileSize, opts.insertRange, random)
+		changes = append(changes, change)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Bytes behind an insertion have moved within tmpFile.
+	var insertOffset, insertLen int64 = fileSize, 0
+	if opts.insertRange != "" {
+		insertOffset, insertLen, _ = parseRange(opts.insertRange)
+	}
+	toTmpOffset := func(offset int64) int64 {
+		if offset >= insertOffset {
+			return offset + insertLen
+		}
+		return offset
+	}
+	for _, region := range regions {
+		regionChanges, err := flipRandomBits(tmpFile, region, random, toTmpOffset, describe)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, regionChanges...)
+	}
+	if opts.zeroRange != "" {
+		offset, length, err := parseRange(opts.zeroRange)
+		if err != nil {
+			return nil, err
+		}
+		if offset+length > fileSize {
+			return nil, errors.New("zero range exceeds the file")
+		}
+		if _, err = tmpFile.WriteAt(make([]byte, length), toTmpOffset(offset)); err != nil {
+			return nil, err
+		}
+		changes = append(changes, fmt.Sprintf("Zeroed %d bytes at offset %d (%s).",
+			length, offset, describe(offset)))
+	}
+	if opts.truncateCnt > 0 {
+		newSize := fileSize + insertLen - opts.truncateCnt
+		if newSize < 0 {
+			return nil, errors.New("cannot truncate more bytes than the file has")
+		}
+		if err = tmpFile.Truncate(newSize); err != nil {
+			return nil, err
+		}
+		changes = append(changes, fmt.Sprintf("Removed the last %d bytes.", opts.truncateCnt))
+	}
+	if len(changes) == 0 {
+		return nil, errors.New("no damage specified")
+	}
+	if err = tmpFile.Close(); err != nil {
+		return nil, err
+	}
+	stat, err := inFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(tmpFile.Name(), stat.Mode()); err != nil {
+		return nil, err
+	}
+	return changes, os.Rename(tmpFile.Name(), outFilename)
+}
+
+// damageRegion is a range of bytes in which bits are flipped.
+type damageRegion struct {
+	offset, size int64
+	bitCnt       int
+}
+
+// getDamageRegions returns the regions in which bits shall be flipped.
+func getDamageRegions(inFilename string, fileSize int64, opts damageOptions) ([]damageRegion, error) {
+	var regions []damageRegion
+	bitCnt := opts.bitCnt
+	if bitCnt == 0 {
+		bitCnt = 1
+	}
+	if opts.shard > 0 {
+		conf, err := getConf(inFilename)
+		if err != nil {
+			return nil, err
+		}
+		if opts.shard > conf.shardCnt() {
+			return nil, fmt.Errorf("there is no shard %d", opts.shard)
+		}
+		offset, size := getShardBounds(conf, opts.shard-1)
+		regions = append(regions, damageRegion{offset, size, bitCnt})
+	}
+	if opts.confCopy >= 0 {
+		if opts.confCopy >= len(confHeaders) {
+			return nil, fmt.Errorf("there is no conf block %d", opts.confCopy)
+		}
+		offset, size, err := findConf(inFilename, fileSize, opts.confCopy)
+		if err != nil {
+			return nil, err
+		}
+		regions = append(regions, damageRegion{offset, size, bitCnt})
+	}
+	if len(regions) == 0 && opts.bitCnt > 0 {
+		regions = append(regions, damageRegion{0, fileSize, opts.bitCnt})
+	}
+	return regions, nil
+}
+
+// findConf returns the offset and size of the i-th copy of the conf.
+func findConf(inFilename string, fileSize int64, i int) (int64, int64, error) {
+	_, format, err := readConfs(inFilename)
+	if err != nil {
+		return -1, -1, err
+	}
+	inFile, err := os.Open(inFilename)
+	if err != nil {
+		return -1, -1, err
+	}
+	defer inFile.Close()
+	return format.findConf(inFile, fileSize, i)
+}
+
+// flipRandomBits flips region.bitCnt distinct, random bits within region.
+func flipRandomBits(file *os.File, region damageRegion, random *rand.Rand,
+	toFileOffset func(int64) int64, describe func(int64) string) ([]string, error) {
+	if region.size <= 0 {
+		return nil, fmt.Errorf("the region at byte %d is empty", region.offset)
+	} else if region.bitCnt < 0 {
+		return nil, errors.New("the number of bits to flip is negative")
+	} else if int64(region.bitCnt) > region.size*8 {
+		return nil, errors.New("more bits to flip than the region has")
+	}
+	var changes []string
+	flipped := make(map[int64]bool)
+	for len(flipped) < region.bitCnt {
+		bitIndex := random.Int63n(region.size * 8)
+		if flipped[bitIndex] {
+			continue
+		}
+		flipped[bitIndex] = true
+		offset := region.offset + bitIndex/8
+		b := make([]byte, 1)
+		if _, err := file.ReadAt(b, toFileOffset(offset)); err != nil {
+			return nil, err
+		}
+		damaged := b[0] ^ (1 << uint(bitIndex%8))
+		if _, err := file.WriteAt([]byte{damaged}, toFileOffset(offset)); err != nil {
+			return nil, err
+		}
+		changes = append(changes, fmt.Sprintf(
+			"Flipped bit %d of byte %d (%s): 0x%02x -> 0x%02x.",
+			bitIndex%8, offset, describe(offset), b[0], damaged))
+	}
+	return changes, nil
+}
+
+// copyWithInsertion copies src to dest and inserts random bytes as
+// described by insertRange.
+func copyWithInsertion(dest io.Writer, src io.Reader, srcSize int64, insertRange string, random *rand.Rand) (string, error) {
+	offset, length, err := parseRange(insertRange)
+	if err != nil {
+		return "", err
+	}
+	if offset > srcSize {
+		return "", errors.New("insert offset lies beyond the end of the file")
+	}
+	if _, err = io.CopyN(dest, src, offset); err != nil {
+		return "", err
+	}
+	if _, err = io.CopyN(dest, random, length); err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(dest, src); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Inserted %d random bytes at offset %d.", length, offset), nil
+}
+
+// describeOffset names the shard or metadata, that contains offset.
+func describeOffset(conf conf, confOK bool, offset int64) string {
+	if !confOK {
+		return "location unknown"
+	}
+	shardCnt := conf.shardCnt()
+	for i := 0; i < shardCnt; i += 1 {
+		shardOffset, size := getShardBounds(conf, i)
+		if offset >= shardOffset && offset < shardOffset+size {
+			if i < int(conf.dataShardCnt) {
+				return fmt.Sprintf("data shard %d", i+1)
+			}
+			return fmt.Sprintf("parity shard %d", i+1)
+		}
+	}
+	return "metadata"
+}
+
+// parseRange parses ranges of the form "OFFSET:LENGTH".
+func parseRange(s string) (offset, length int64, err error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return -1, -1, fmt.Errorf("range '%s' is not of the form OFFSET:LENGTH", s)
+	}
+	if offset, err = strconv.ParseInt(parts[0], 10, 64); err != nil || offset < 0 {
+		return -1, -1, fmt.Errorf("invalid offset in range '%s'", s)
+	}
+	if length, err = strconv.ParseInt(parts[1], 10, 64); err != nil || length < 0 {
+		return -1, -1, fmt.Errorf("invalid length in range '%s'", s)
+	}
+	return offset, length, nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestFlipRandomBitsRejectsEmptyRegion(t *testing.T) {
+	file, err := ioutil.TempFile("", "pres_test_damage_*")
+	if err != nil {
+		t.Fatalf("Error creating tempfile: %s", err.Error())
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	random := rand.New(rand.NewSource(1))
+	identity := func(offset int64) int64 { return offset }
+	describe := func(int64) string { return "" }
+	for _, region := range []damageRegion{{0, 0, 0}, {0, 0, 1}} {
+		if _, err = flipRandomBits(file, region, random, identity, describe); err == nil {
+			t.Errorf("Empty region with %d bits to flip was accepted", region.bitCnt)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// The data of encrypted *.pres files is encrypted before sharding, so
+// that the parity information and checksums are calculated over the
+// ciphertext; verify, upgrade and reencode work without the passphrase.
+//
+// The plaintext is split into chunks of encryption.chunkSize bytes, which
+// are sealed with AES-256-GCM one after another. The nonce of a chunk is
+// its index, followed by a byte, that marks the last chunk, so that
+// chunks can neither be reordered nor dropped. The key is derived from a
+// passphrase with scrypt.
+
+// encryptInput is set with -encrypt. The passphrase is read from
+// passphraseFilename, set with -passphrase-file, or else from the
+// PRES_PASSPHRASE environment variable.
+var (
+	encryptInput       bool
+	passphraseFilename string
+	passphrase         []byte
+)
+
+const passphraseEnv = "PRES_PASSPHRASE"
+
+// encryption describes how the data of a *.pres file is encrypted. The
+// zero value describes unencrypted data.
+type encryption struct {
+	cipher    string // Only "aes-256-gcm" is supported.
+	chunkSize uint32
+	plainLen  int64
+	// The parameters for scrypt; N is 1<<scryptLogN.
+	scryptLogN, scryptR, scryptP uint8
+	salt                         string
+	keyCheck                     string // Identifies the right passphrase.
+}
+
+const encryptionChunkSize = 64 * 1024
+
+func (e encryption) isEnabled() bool {
+	return e.cipher != ""
+}
+
+func newEncryption(plainLen int64) (encryption, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return encryption{}, err
+	}
+	return encryption{
+		cipher:     "aes-256-gcm",
+		chunkSize:  encryptionChunkSize,
+		plainLen:   plainLen,
+		scryptLogN: 15,
+		scryptR:    8,
+		scryptP:    1,
+		salt:       string(salt),
+	}, nil
+}
+
+func (e encryption) chunkCnt() int64 {
+	if e.plainLen == 0 {
+		return 1
+	}
+	return (e.plainLen + int64(e.chunkSize) - 1) / int64(e.chunkSize)
+}
+
+// encryptedLen returns the length of the ciphertext.
+func (e encryption) encryptedLen() int64 {
+	return e.plainLen + e.chunkCnt()*16
+}
+
+// seemsOK checks the parameters before they are used. Large scrypt
+// parameters would take too much time or memory.
+func (e encryption) seemsOK() error {
+	if e.cipher != "aes-256-gcm" {
+		return fmt.Errorf("unsupported cipher '%s'", e.cipher)
+	}
+	if e.chunkSize == 0 || e.plainLen < 0 || e.scryptLogN > 22 ||
+		e.scryptR == 0 || e.scryptP == 0 || int(e.scryptR)*int(e.scryptP) > 64 {
+		return errors.New("invalid encryption parameters")
+	}
+	return nil
+}
+
+// newAEAD derives the key from passphrase and checks it against the
+// keyCheck, if there is one already.
+func (e *encryption) newAEAD(passphrase []byte) (cipher.AEAD, error) {
+	if passphrase == nil {
+		return nil, fmt.Errorf("the data is encrypted, but no passphrase was given with -passphrase-file or in %s",
+			passphraseEnv)
+	}
+	if err := e.seemsOK(); err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key(passphrase, []byte(e.salt), 1<<e.scryptLogN,
+		int(e.scryptR), int(e.scryptP), 32)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("pres key check"))
+	keyCheck := string(mac.Sum(nil)[:8])
+	if e.keyCheck == "" {
+		e.keyCheck = keyCheck
+	} else if !hmac.Equal([]byte(keyCheck), []byte(e.keyCheck)) {
+		return nil, errors.New("wrong passphrase")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (e encryption) nonce(aead cipher.AEAD, i int64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, uint64(i))
+	if i == e.chunkCnt()-1 {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+func (e encryption) encrypt(w io.Writer, r io.Reader, aead cipher.AEAD) error {
+	buf := make([]byte, e.chunkSize, int(e.chunkSize)+aead.Overhead())
+	for i := int64(0); i < e.chunkCnt(); i += 1 {
+		n, err := io.ReadFull(r, buf[:e.chunkSize])
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(aead.Seal(buf[:0], e.nonce(aead, i), buf[:n], nil)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e encryption) decrypt(w io.Writer, r io.Reader, aead cipher.AEAD) error {
+	buf := make([]byte, int(e.chunkSize)+aead.Overhead())
+	remaining := e.plainLen
+	for i := int64(0); i < e.chunkCnt(); i += 1 {
+		n := min64(remaining, int64(e.chunkSize)) + int64(aead.Overhead())
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			return err
+		}
+		plaintext, err := aead.Open(buf[:0], e.nonce(aead, i), buf[:n], nil)
+		if err != nil {
+			return fmt.Errorf("could not decrypt chunk %d: %s", i+1, err.Error())
+		}
+		if _, err = w.Write(plaintext); err != nil {
+			return err
+		}
+		remaining -= int64(len(plaintext))
+	}
+	return nil
+}
+
+func loadPassphrase() error {
+	if passphraseFilename != "" {
+		content, err := ioutil.ReadFile(passphraseFilename)
+		if err != nil {
+			return err
+		}
+		// Files written with echo end with a newline:
+		passphrase = bytes.TrimSuffix(bytes.TrimSuffix(content, []byte("\n")), []byte("\r"))
+	} else if env, ok := os.LookupEnv(passphraseEnv); ok {
+		passphrase = []byte(env)
+	}
+	if passphrase != nil && len(passphrase) == 0 {
+		return errors.New("the passphrase is empty")
+	}
+	return nil
+}
+
+// encryptToTempFile encrypts inFilename to a new temporary file in dir
+// and returns its name. The keyCheck of encryption is set.
+func encryptToTempFile(inFilename, dir string, encryption *encryption) (string, error) {
+	aead, err := encryption.newAEAD(passphrase)
+	if err != nil {
+		return "", err
+	}
+	inFile, err := os.Open(inFilename)
+	if err != nil {
+		return "", err
+	}
+	defer inFile.Close()
+	tmpFile, err := createTempFile(dir, ".pres_create_*")
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(os.Stderr, "Encrypting '%s'.\n", inFilename)
+	err = encryption.encrypt(tmpFile, io.LimitReader(inFile, encryption.plainLen), aead)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return "", err
+	}
+	return tmpFile.Name(), nil
+}
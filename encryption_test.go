@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestEncryptedFilesNeedThePassphraseOnlyToRestore(t *testing.T) {
+	dataFilename, err := createTestInputWithSize(200000)
+	if err != nil {
+		t.Fatalf("Error creating tempfile: %s", err.Error())
+	}
+	defer os.Remove(dataFilename)
+	original, err := ioutil.ReadFile(dataFilename)
+	if err != nil {
+		t.Fatalf("Error reading input: %s", err.Error())
+	}
+	defer func() { encryptInput, passphrase = false, nil }()
+	encryptInput, passphrase = true, []byte("secret")
+	createPresFile(dataFilename)
+	encryptInput, passphrase = false, nil
+	presFilename := fmt.Sprint(dataFilename, ".pres")
+	defer os.Remove(presFilename)
+
+	result, err := checkPresFile(presFilename)
+	if err != nil {
+		t.Fatalf("Error checking *.pres file: %s", err.Error())
+	}
+	if !result.conf.encryption.isEnabled() || len(result.damagedShards()) > 0 {
+		t.Fatalf("Encrypted file has damaged shards %v", result.damagedShards())
+	}
+	presContent, err := ioutil.ReadFile(presFilename)
+	if err != nil {
+		t.Fatalf("Error reading *.pres file: %s", err.Error())
+	}
+	if bytes.Contains(presContent, original[:1000]) {
+		t.Errorf("The *.pres file contains the plaintext")
+	}
+	if err = damageShard(presFilename, result.conf, 0); err != nil {
+		t.Fatalf("Error damaging shard: %s", err.Error())
+	}
+	shardStates, err := getShardStates(presFilename, result.conf)
+	if err != nil {
+		t.Fatalf("Error checking shards: %s", err.Error())
+	}
+
+	outFilename := fmt.Sprint(dataFilename, ".restored")
+	defer os.Remove(outFilename)
+	passphrase = []byte("wrong")
+	if err = restoreAndDecode(presFilename, outFilename, shardStates, result.conf, passphrase); err == nil {
+		t.Errorf("Restoring with the wrong passphrase succeeded")
+	}
+	passphrase = []byte("secret")
+	if err = restoreAndDecode(presFilename, outFilename, shardStates, result.conf, passphrase); err != nil {
+		t.Fatalf("Error restoring: %s", err.Error())
+	}
+	restored, err := ioutil.ReadFile(outFilename)
+	if err != nil {
+		t.Fatalf("Error reading restored data: %s", err.Error())
+	}
+	if !bytes.Equal(restored, original) {
+		t.Errorf("The restored data differs from the original")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// currentVersion is the version of the format in which new *.pres
+// files are written, unless another one is requested or needed.
+const currentVersion = "1"
+
+// format describes how the metadata of one version of the *.pres format
+// is read and written.
+type format struct {
+	version string
+	// confNames are the names of the copies of the conf.
+	confNames []string
+	// readConfs reads all copies of the conf from the end of inFile. If
+	// inFile's metadata is not in this format, errOtherFormat must be
+	// returned.
+	readConfs func(inFile *os.File, fileSize int64) ([]conf, error)
+	// writeMetadata writes all copies of conf.
+	writeMetadata func(w io.Writer, conf conf) error
+	// findConf returns the offset and size of the i-th copy of the conf
+	// in inFile.
+	findConf func(inFile *os.File, fileSize int64, i int) (int64, int64, error)
+	// canStore returns an error, if conf cannot be stored in this format.
+	canStore func(conf conf) error
+}
+
+var errOtherFormat = errors.New("metadata is in a different format")
+
+// formats are all supported formats. When reading a file, they are tried
+// in this order, so formats that cannot reliably recognize their own
+// metadata, like version 1, must come last.
+var formats = []format{
+	formatV2,
+	formatV1,
+}
+
+func getFormat(version string) (format, error) {
+	for _, format := range formats {
+		if format.version == version {
+			return format, nil
+		}
+	}
+	return format{}, fmt.Errorf("unsupported format version '%s'", version)
+}
+
+// chooseVersion returns the version in which conf shall be written: the
+// one given with -format or else preferred. If no version was given and
+// preferred cannot store conf, the first format that can is chosen.
+func chooseVersion(conf conf, preferred string) (string, error) {
+	if formatVersion != "" {
+		preferred = formatVersion
+	}
+	format, err := getFormat(preferred)
+	if err != nil {
+		return "", err
+	}
+	if err = format.canStore(conf); err == nil || formatVersion != "" {
+		return preferred, err
+	}
+	for _, format := range formats {
+		if format.canStore(conf) == nil {
+			return format.version, nil
+		}
+	}
+	return "", err
+}
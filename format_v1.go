@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Version 1 of the format stores three copies of the conf as text blocks
+// at the end of the file. See the "File Format Example" in README.md.
+
+// confHeaders are the headers of the conf blocks, in the order in which
+// they are written.
+var confHeaders = []string{"[conf]", "[conf_copy_1]", "[conf_copy_2]"}
+
+var formatV1 = format{
+	version:       "1",
+	confNames:     confHeaders,
+	readConfs:     readV1Confs,
+	writeMetadata: writeV1Metadata,
+	findConf:      findV1Conf,
+	canStore:      canStoreInV1,
+}
+
+func readV1Confs(inFile *os.File, fileSize int64) ([]conf, error) {
+	// Seek to a point where the metadata isn't far away (for performance):
+	if _, err := inFile.Seek(-min64(fileSize, 32e3), 2); err != nil {
+		return nil, err
+	}
+	return parseConfs(inFile)
+}
+
+func writeV1Metadata(w io.Writer, conf conf) error {
+	if _, err := fmt.Fprintln(w, "\n\n[conf]"); err != nil {
+		return err
+	}
+	if err := writeConf(w, conf); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(w, "\n[conf_copy_1]"); err != nil {
+		return err
+	}
+	if err := writeConf(w, conf); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(w, "\n[conf_copy_2]"); err != nil {
+		return err
+	}
+	return writeConf(w, conf)
+}
+
+// findV1Conf returns the offset and size of the conf block with the
+// given index, including its header.
+func findV1Conf(inFile *os.File, fileSize int64, i int) (int64, int64, error) {
+	// Only search where readV1Confs searches:
+	tailOffset := fileSize - min64(fileSize, 32e3)
+	tail := make([]byte, fileSize-tailOffset)
+	if _, err := inFile.ReadAt(tail, tailOffset); err != nil {
+		return -1, -1, err
+	}
+	header := confHeaders[i]
+	start := bytes.LastIndex(tail, []byte(fmt.Sprint(header, "\n")))
+	if start < 0 {
+		return -1, -1, fmt.Errorf("could not find %s", header)
+	}
+	size := bytes.Index(tail[start+1:], []byte("\n[conf"))
+	if size < 0 {
+		size = len(tail) - start
+	} else {
+		size += 1
+	}
+	return tailOffset + int64(start), int64(size), nil
+}
+
+// canStoreInV1 checks that conf only uses features of version 1. The
+// fields, that were introduced later, are informational and dropped.
+func canStoreInV1(conf conf) error {
+	if conf.hashAlgorithm != "crc32c" {
+		return errors.New("version 1 only supports crc32c checksums")
+	}
+	if conf.signature != nil || conf.publicKey != nil {
+		return errors.New("version 1 does not support signatures")
+	}
+	if conf.encryption.isEnabled() {
+		return errors.New("version 1 does not support encryption")
+	}
+	if conf.compression.isEnabled() {
+		return errors.New("version 1 does not support compression")
+	}
+	if conf.archive.isEnabled() {
+		return errors.New("version 1 does not support archives")
+	}
+	if conf.tarIndex != nil {
+		return errors.New("version 1 does not support tar indexes")
+	}
+	if conf.volume.isEnabled() {
+		return errors.New("version 1 does not support volumes")
+	}
+	return nil
+}
+
+func writeConf(outputFile io.Writer, conf conf) error {
+	_, err := fmt.Fprintf(outputFile, "version=%s\n", conf.version)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(outputFile, "data_len=%d\n", conf.dataLen)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(outputFile, "data_shard_cnt=%d\n", conf.dataShardCnt)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(outputFile, "parity_shard_cnt=%d\n", conf.parityShardCnt)
+	if err != nil {
+		return err
+	}
+	for i, crc32c := range conf.shardHashes {
+		_, err = fmt.Fprintf(outputFile, "shard_%d_crc32c=%s\n", i+1, crc32c)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseConfs parses the [conf], [conf_copy_1] and [conf_copy_2] blocks
+// from r. Values that cannot be parsed are ignored, which leaves the
+// respective field unset, so that the conf does not seem OK.
+func parseConfs(r io.Reader) ([]conf, error) {
+	confs := make([]conf, 3)
+	shardHashes := make([]map[int]string, 3)
+	for i := range shardHashes {
+		shardHashes[i] = make(map[int]string)
+	}
+	inputReader := bufio.NewReader(r)
+	var confIndex int = -1
+	var line string
+	var err error
+	reShard := regexp.MustCompile(`^shard_([0-9]+)_crc32c=(.*)`)
+	for err = nil; err == nil; line, err = inputReader.ReadString('\n') {
+		line = strings.TrimSpace(line)
+		switch line {
+		case "[conf]":
+			confIndex = 0
+			continue
+		case "[conf_copy_1]":
+			confIndex = 1
+			continue
+		case "[conf_copy_2]":
+			confIndex = 2
+			continue
+		}
+		if confIndex < 0 {
+			// There were probably damaged lines at the beginning of the metadata.
+			continue
+		}
+		c := &confs[confIndex]
+		switch {
+		case strings.HasPrefix(line, "version="):
+			c.version = strings.SplitAfterN(line, "=", 2)[1]
+		case strings.HasPrefix(line, "data_len="):
+			s := strings.SplitAfterN(line, "=", 2)[1]
+			if x, parseErr := strconv.ParseInt(s, 10, 64); parseErr == nil {
+				c.dataLen = x
+			}
+		case strings.HasPrefix(line, "data_shard_cnt="):
+			s := strings.SplitAfterN(line, "=", 2)[1]
+			if x, parseErr := strconv.ParseUint(s, 10, 8); parseErr == nil {
+				c.dataShardCnt = uint8(x)
+			}
+		case strings.HasPrefix(line, "parity_shard_cnt="):
+			s := strings.SplitAfterN(line, "=", 2)[1]
+			if x, parseErr := strconv.ParseUint(s, 10, 8); parseErr == nil {
+				c.parityShardCnt = uint8(x)
+			}
+		case reShard.MatchString(line):
+			matches := reShard.FindStringSubmatch(line)
+			shardNumber, parseErr := strconv.Atoi(matches[1])
+			if parseErr != nil || shardNumber < 1 || shardNumber > maxShardCnt {
+				continue
+			}
+			if _, parseErr = strconv.ParseUint(matches[2], 10, 32); parseErr != nil {
+				continue
+			}
+			shardHashes[confIndex][shardNumber-1] = matches[2]
+		}
+	}
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	for i := range confs {
+		// Version 1 only supports CRC32C.
+		confs[i].hashAlgorithm = "crc32c"
+		shardCnt := confs[i].shardCnt()
+		if shardCnt > maxShardCnt {
+			continue
+		}
+		// Checksums of shards, that are not within shardCnt, are dropped.
+		confs[i].shardHashes = make([]string, shardCnt)
+		for j := range confs[i].shardHashes {
+			confs[i].shardHashes[j] = shardHashes[i][j]
+		}
+	}
+	return confs, nil
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// Version 2 of the format stores three copies of the conf in a compact,
+// binary encoding, followed by two copies of a fixed-size trailer, that
+// points to them. Thus, the metadata is found by reading the end of the
+// file, no matter how large it is. All integers are big-endian.
+//
+// A copy of the conf:
+//
+//	magic             "PRESCONF"
+//	body length       uint32
+//	body:
+//	  data length     uint64
+//	  data shards     uint16
+//	  parity shards   uint16
+//	  hash algorithm  uint8 length, followed by the name
+//	  digest size     uint16
+//	  digests         one per shard, each of digest size bytes
+//	  fields          any number of: uint16 tag, uint32 length, value
+//	CRC32C            uint32, of everything before
+//
+// The trailer:
+//
+//	magic             "PRESTRLR"
+//	version           uint16
+//	copy count        uint16
+//	copy length       uint64, the size of each copy of the conf
+//	CRC32C            uint32, of everything before
+
+const (
+	v2ConfMagic    = "PRESCONF"
+	v2TrailerMagic = "PRESTRLR"
+	v2TrailerSize  = 24
+)
+
+// Tags of the optional fields of a conf. Readers must understand all
+// fields with the v2Critical bit set and may skip the others.
+const (
+	v2Critical = 0x8000
+
+	v2FieldFilename   = 1
+	v2FieldModified   = 2
+	v2FieldCreated    = 3
+	v2FieldDataSHA256 = 4
+	v2FieldSignature  = 5
+	v2FieldPublicKey  = 6
+	v2FieldKeyCheck   = 7
+	// Older readers must not mistake the ciphertext for the data:
+	v2FieldEncryption = v2Critical | 8
+	// Older readers must not mistake the compressed data for the data:
+	v2FieldCompression = v2Critical | 9
+	// Older readers must not restore an archive as a single file:
+	v2FieldArchive = v2Critical | 10
+	// Older readers can still restore a tar file without its index:
+	v2FieldTarIndex = 11
+	// A volume does not contain all shards:
+	v2FieldVolume = v2Critical | 12
+)
+
+var formatV2 = format{
+	version:       "2",
+	confNames:     []string{"Conf copy 0", "Conf copy 1", "Conf copy 2"},
+	readConfs:     readV2Confs,
+	writeMetadata: writeV2Metadata,
+	findConf:      findV2Conf,
+	canStore:      func(conf conf) error { return nil },
+}
+
+// errDamagedConf is returned for copies of the conf, that cannot be
+// decoded.
+var errDamagedConf = errors.New("conf is damaged")
+
+type v2Trailer struct {
+	version    uint16
+	copyCnt    uint16
+	copyLength uint64
+}
+
+type v2Field struct {
+	tag   uint16
+	value []byte
+}
+
+func readV2Confs(inFile *os.File, fileSize int64) ([]conf, error) {
+	trailer, err := readV2Trailer(inFile, fileSize)
+	if err != nil {
+		return nil, err
+	}
+	confs := make([]conf, trailer.copyCnt)
+	for i := range confs {
+		offset, size := trailer.getConfBounds(fileSize, i)
+		b := make([]byte, size)
+		if _, err = inFile.ReadAt(b, offset); err != nil {
+			return nil, err
+		}
+		confs[i], err = decodeV2Conf(b)
+		if err == errDamagedConf {
+			confs[i] = conf{}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		confs[i].version = "2"
+	}
+	return confs, nil
+}
+
+// readV2Trailer reads the trailers at the end of inFile and returns the
+// first intact one. If neither contains the magic bytes, errOtherFormat
+// is returned.
+func readV2Trailer(inFile *os.File, fileSize int64) (v2Trailer, error) {
+	var trailer v2Trailer
+	if fileSize < 2*v2TrailerSize {
+		return trailer, errOtherFormat
+	}
+	b := make([]byte, 2*v2TrailerSize)
+	if _, err := inFile.ReadAt(b, fileSize-int64(len(b))); err != nil {
+		return trailer, err
+	}
+	foundMagic := false
+	for _, t := range [][]byte{b[v2TrailerSize:], b[:v2TrailerSize]} {
+		if string(t[:8]) != v2TrailerMagic {
+			continue
+		}
+		foundMagic = true
+		if crc32.Checksum(t[:20], castagnoliTable) != binary.BigEndian.Uint32(t[20:]) {
+			continue
+		}
+		trailer.version = binary.BigEndian.Uint16(t[8:])
+		trailer.copyCnt = binary.BigEndian.Uint16(t[10:])
+		trailer.copyLength = binary.BigEndian.Uint64(t[12:])
+		if trailer.version != 2 {
+			return trailer, fmt.Errorf("unsupported format version '%d'", trailer.version)
+		}
+		metadataLen := fileSize - 2*v2TrailerSize
+		if trailer.copyCnt != uint16(len(confHeaders)) ||
+			trailer.copyLength > uint64(metadataLen)/uint64(trailer.copyCnt) {
+			return trailer, errors.New("the trailer does not fit the file")
+		}
+		return trailer, nil
+	}
+	if !foundMagic {
+		return trailer, errOtherFormat
+	}
+	return trailer, errors.New("both trailers are damaged")
+}
+
+// findV2Conf returns the offset and size of the i-th copy of the conf.
+func findV2Conf(inFile *os.File, fileSize int64, i int) (int64, int64, error) {
+	trailer, err := readV2Trailer(inFile, fileSize)
+	if err != nil {
+		return -1, -1, err
+	}
+	offset, size := trailer.getConfBounds(fileSize, i)
+	return offset, size, nil
+}
+
+// getConfBounds returns the offset and size of the i-th copy of the conf
+// in a file of the given size.
+func (t v2Trailer) getConfBounds(fileSize int64, i int) (int64, int64) {
+	size := int64(t.copyLength)
+	return fileSize - 2*v2TrailerSize - int64(int(t.copyCnt)-i)*size, size
+}
+
+func writeV2Metadata(w io.Writer, conf conf) error {
+	encodedConf, err := encodeV2Conf(conf)
+	if err != nil {
+		return err
+	}
+	for range confHeaders {
+		if _, err = w.Write(encodedConf); err != nil {
+			return err
+		}
+	}
+	trailer := make([]byte, v2TrailerSize)
+	copy(trailer, v2TrailerMagic)
+	binary.BigEndian.PutUint16(trailer[8:], 2)
+	binary.BigEndian.PutUint16(trailer[10:], uint16(len(confHeaders)))
+	binary.BigEndian.PutUint64(trailer[12:], uint64(len(encodedConf)))
+	binary.BigEndian.PutUint32(trailer[20:], crc32.Checksum(trailer[:20], castagnoliTable))
+	for i := 0; i < 2; i += 1 {
+		if _, err = w.Write(trailer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeV2Conf(conf conf) ([]byte, error) {
+	if len(conf.hashAlgorithm) > 255 || len(conf.shardHashes) == 0 {
+		return nil, errors.New("invalid conf")
+	}
+	digests := make([][]byte, len(conf.shardHashes))
+	for i, hash := range conf.shardHashes {
+		var err error
+		if digests[i], err = parseSum(conf.hashAlgorithm, hash); err != nil {
+			return nil, err
+		}
+		if len(digests[i]) != len(digests[0]) || len(digests[i]) > 0xffff {
+			return nil, errors.New("the checksums have different sizes")
+		}
+	}
+	body := new(bytes.Buffer)
+	// Writing to a bytes.Buffer cannot fail.
+	binary.Write(body, binary.BigEndian, uint64(conf.dataLen))
+	binary.Write(body, binary.BigEndian, uint16(conf.dataShardCnt))
+	binary.Write(body, binary.BigEndian, uint16(conf.parityShardCnt))
+	body.WriteByte(uint8(len(conf.hashAlgorithm)))
+	body.WriteString(conf.hashAlgorithm)
+	binary.Write(body, binary.BigEndian, uint16(len(digests[0])))
+	for _, digest := range digests {
+		body.Write(digest)
+	}
+	for _, field := range getV2Fields(conf) {
+		binary.Write(body, binary.BigEndian, field.tag)
+		binary.Write(body, binary.BigEndian, uint32(len(field.value)))
+		body.Write(field.value)
+	}
+
+	encodedConf := new(bytes.Buffer)
+	encodedConf.WriteString(v2ConfMagic)
+	binary.Write(encodedConf, binary.BigEndian, uint32(body.Len()))
+	encodedConf.Write(body.Bytes())
+	crc := crc32.Checksum(encodedConf.Bytes(), castagnoliTable)
+	binary.Write(encodedConf, binary.BigEndian, crc)
+	return encodedConf.Bytes(), nil
+}
+
+// decodeV2Conf decodes one copy of the conf. If it is damaged,
+// errDamagedConf is returned.
+func decodeV2Conf(b []byte) (conf, error) {
+	var conf conf
+	if len(b) < len(v2ConfMagic)+8 || string(b[:len(v2ConfMagic)]) != v2ConfMagic {
+		return conf, errDamagedConf
+	}
+	crc := binary.BigEndian.Uint32(b[len(b)-4:])
+	if crc32.Checksum(b[:len(b)-4], castagnoliTable) != crc {
+		return conf, errDamagedConf
+	}
+	r := bytes.NewReader(b[len(v2ConfMagic) : len(b)-4])
+	var bodyLen uint32
+	var dataLen uint64
+	var dataShardCnt, parityShardCnt, digestSize uint16
+	var algorithmLen uint8
+	for _, x := range []interface{}{&bodyLen, &dataLen, &dataShardCnt, &parityShardCnt, &algorithmLen} {
+		if binary.Read(r, binary.BigEndian, x) != nil {
+			return conf, errDamagedConf
+		}
+	}
+	shardCnt := int(dataShardCnt) + int(parityShardCnt)
+	if int64(bodyLen) != int64(r.Size())-4 || dataLen > 1<<63-1 ||
+		dataShardCnt > 255 || parityShardCnt > 255 || shardCnt > maxShardCnt {
+		return conf, errDamagedConf
+	}
+	algorithm := make([]byte, algorithmLen)
+	if _, err := io.ReadFull(r, algorithm); err != nil ||
+		binary.Read(r, binary.BigEndian, &digestSize) != nil ||
+		int64(shardCnt)*int64(digestSize) > int64(r.Len()) {
+		return conf, errDamagedConf
+	}
+	conf.dataLen = int64(dataLen)
+	conf.dataShardCnt = uint8(dataShardCnt)
+	conf.parityShardCnt = uint8(parityShardCnt)
+	conf.hashAlgorithm = string(algorithm)
+	conf.shardHashes = make([]string, shardCnt)
+	digest := make([]byte, digestSize)
+	for i := range conf.shardHashes {
+		io.ReadFull(r, digest)
+		conf.shardHashes[i] = formatSum(conf.hashAlgorithm, digest)
+	}
+	for r.Len() > 0 {
+		var field v2Field
+		var length uint32
+		if binary.Read(r, binary.BigEndian, &field.tag) != nil ||
+			binary.Read(r, binary.BigEndian, &length) != nil ||
+			int64(length) > int64(r.Len()) {
+			return conf, errDamagedConf
+		}
+		field.value = make([]byte, length)
+		io.ReadFull(r, field.value)
+		if err := setV2Field(&conf, field); err != nil {
+			return conf, err
+		}
+	}
+	return conf, nil
+}
+
+// getV2Fields returns the optional fields, that represent conf.
+func getV2Fields(conf conf) []v2Field {
+	var fields []v2Field
+	if conf.filename != "" {
+		fields = append(fields, v2Field{v2FieldFilename, []byte(conf.filename)})
+	}
+	if conf.modified != 0 {
+		fields = append(fields, v2Field{v2FieldModified, encodeInt64(conf.modified)})
+	}
+	if conf.created != 0 {
+		fields = append(fields, v2Field{v2FieldCreated, encodeInt64(conf.created)})
+	}
+	if conf.dataSHA256 != "" {
+		digest, _ := hex.DecodeString(conf.dataSHA256)
+		fields = append(fields, v2Field{v2FieldDataSHA256, digest})
+	}
+	if conf.signature != nil {
+		fields = append(fields, v2Field{v2FieldSignature, conf.signature})
+	}
+	if conf.publicKey != nil {
+		fields = append(fields, v2Field{v2FieldPublicKey, conf.publicKey})
+	}
+	if conf.keyCheck != nil {
+		fields = append(fields, v2Field{v2FieldKeyCheck, conf.keyCheck})
+	}
+	if conf.encryption.isEnabled() {
+		fields = append(fields, v2Field{v2FieldEncryption, encodeEncryption(conf.encryption)})
+	}
+	if c := conf.compression; c.isEnabled() {
+		value := append([]byte{uint8(len(c.codec))}, c.codec...)
+		value = append(value, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(value[len(value)-8:], uint64(c.origLen))
+		fields = append(fields, v2Field{v2FieldCompression, value})
+	}
+	if a := conf.archive; a.isEnabled() {
+		value := append(encodeInt64(a.indexOffset), encodeInt64(a.indexLen)...)
+		fields = append(fields, v2Field{v2FieldArchive, value})
+	}
+	if conf.tarIndex != nil {
+		fields = append(fields, v2Field{v2FieldTarIndex, conf.tarIndex})
+	}
+	if v := conf.volume; v.isEnabled() {
+		value := make([]byte, 6)
+		binary.BigEndian.PutUint16(value, v.number)
+		binary.BigEndian.PutUint16(value[2:], v.count)
+		binary.BigEndian.PutUint16(value[4:], v.shardsPerVolume)
+		fields = append(fields, v2Field{v2FieldVolume, value})
+	}
+	return fields
+}
+
+// setV2Field sets the value of field in conf. Unknown fields are
+// skipped, unless they are critical.
+func setV2Field(conf *conf, field v2Field) error {
+	switch field.tag {
+	case v2FieldFilename:
+		conf.filename = string(field.value)
+	case v2FieldModified, v2FieldCreated:
+		if len(field.value) != 8 {
+			return errDamagedConf
+		}
+		x := int64(binary.BigEndian.Uint64(field.value))
+		if field.tag == v2FieldModified {
+			conf.modified = x
+		} else {
+			conf.created = x
+		}
+	case v2FieldDataSHA256:
+		conf.dataSHA256 = hex.EncodeToString(field.value)
+	case v2FieldSignature:
+		conf.signature = field.value
+	case v2FieldPublicKey:
+		conf.publicKey = field.value
+	case v2FieldKeyCheck:
+		conf.keyCheck = field.value
+	case v2FieldCompression:
+		value := field.value
+		if len(value) == 0 || len(value) != 1+int(value[0])+8 || value[0] == 0 {
+			return errDamagedConf
+		}
+		conf.compression.codec = string(value[1 : 1+value[0]])
+		conf.compression.origLen = int64(binary.BigEndian.Uint64(value[1+value[0]:]))
+		if conf.compression.origLen < 0 {
+			return errDamagedConf
+		}
+	case v2FieldArchive:
+		if len(field.value) != 16 {
+			return errDamagedConf
+		}
+		conf.archive.indexOffset = int64(binary.BigEndian.Uint64(field.value))
+		conf.archive.indexLen = int64(binary.BigEndian.Uint64(field.value[8:]))
+	case v2FieldTarIndex:
+		conf.tarIndex = field.value
+	case v2FieldVolume:
+		if len(field.value) != 6 {
+			return errDamagedConf
+		}
+		v := volume{
+			number:          binary.BigEndian.Uint16(field.value),
+			count:           binary.BigEndian.Uint16(field.value[2:]),
+			shardsPerVolume: binary.BigEndian.Uint16(field.value[4:]),
+		}
+		if v.number == 0 || v.number > v.count || v.shardsPerVolume == 0 {
+			return errDamagedConf
+		}
+		conf.volume = v
+	case v2FieldEncryption:
+		var err error
+		if conf.encryption, err = decodeEncryption(field.value); err != nil {
+			return errDamagedConf
+		}
+	default:
+		if field.tag&v2Critical != 0 {
+			return fmt.Errorf("unsupported field %d in conf; it was probably written by a newer version of pres",
+				field.tag)
+		}
+	}
+	return nil
+}
+
+func encodeInt64(x int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(x))
+	return b
+}
+
+// encodeEncryption encodes the cipher, chunk size, plaintext length,
+// scrypt parameters, salt and key check of e. Strings are prefixed with
+// their length as uint8.
+func encodeEncryption(e encryption) []byte {
+	b := new(bytes.Buffer)
+	b.WriteByte(uint8(len(e.cipher)))
+	b.WriteString(e.cipher)
+	binary.Write(b, binary.BigEndian, e.chunkSize)
+	binary.Write(b, binary.BigEndian, e.plainLen)
+	b.Write([]byte{e.scryptLogN, e.scryptR, e.scryptP})
+	for _, s := range []string{e.salt, e.keyCheck} {
+		b.WriteByte(uint8(len(s)))
+		b.WriteString(s)
+	}
+	return b.Bytes()
+}
+
+func decodeEncryption(value []byte) (encryption, error) {
+	var e encryption
+	r := bytes.NewReader(value)
+	var err error
+	readString := func() string {
+		var n uint8
+		if err == nil {
+			err = binary.Read(r, binary.BigEndian, &n)
+		}
+		s := make([]byte, n)
+		if err == nil {
+			_, err = io.ReadFull(r, s)
+		}
+		return string(s)
+	}
+	read := func(x interface{}) {
+		if err == nil {
+			err = binary.Read(r, binary.BigEndian, x)
+		}
+	}
+	e.cipher = readString()
+	read(&e.chunkSize)
+	read(&e.plainLen)
+	read(&e.scryptLogN)
+	read(&e.scryptR)
+	read(&e.scryptP)
+	e.salt = readString()
+	e.keyCheck = readString()
+	if err == nil && (r.Len() > 0 || e.cipher == "" || e.plainLen < 0 || e.chunkSize == 0) {
+		err = errDamagedConf
+	}
+	return e, err
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"testing"
+)
+
+func FuzzDecodeV2Conf(f *testing.F) {
+	encodedConf, err := encodeV2Conf(exampleV2Conf())
+	if err != nil {
+		f.Fatalf("Error encoding conf: %s", err.Error())
+	}
+	f.Add(encodedConf, int64(2000))
+	f.Add(encodedConf, int64(997))
+	f.Add(appendV2Field(encodedConf, 99, []byte("x")), int64(2000))
+	f.Add(encodedConf[:len(encodedConf)-10], int64(2000))
+	f.Fuzz(func(t *testing.T, encodedConf []byte, fileSize int64) {
+		// Most mutations would otherwise only be caught by the checksum:
+		if len(encodedConf) > 4 {
+			n := len(encodedConf) - 4
+			crc := crc32.Checksum(encodedConf[:n], castagnoliTable)
+			binary.BigEndian.PutUint32(encodedConf[n:], crc)
+		}
+		conf, err := decodeV2Conf(encodedConf)
+		if err != nil {
+			return
+		}
+		conf.version = "2"
+		if conf.seemsOK(fileSize) {
+			checkConsistency(t, conf, fileSize)
+		}
+	})
+}
+
+func TestV2ConfRoundTrip(t *testing.T) {
+	conf := exampleV2Conf()
+	encodedConf, err := encodeV2Conf(conf)
+	if err != nil {
+		t.Fatalf("Error encoding conf: %s", err.Error())
+	}
+	decodedConf, err := decodeV2Conf(encodedConf)
+	if err != nil {
+		t.Fatalf("Error decoding conf: %s", err.Error())
+	}
+	decodedConf.version = conf.version
+	if !decodedConf.equals(conf) {
+		t.Errorf("Decoded conf differs in %v", conf.differences(decodedConf))
+	}
+
+	decodedConf, err = decodeV2Conf(appendV2Field(encodedConf, 99, []byte("x")))
+	if err != nil {
+		t.Errorf("Unknown field was not skipped: %s", err.Error())
+	}
+	_, err = decodeV2Conf(appendV2Field(encodedConf, v2Critical|99, []byte("x")))
+	if err == nil || err == errDamagedConf {
+		t.Errorf("Unknown critical field was not rejected")
+	}
+	encodedConf[len(encodedConf)/2] ^= 0xff
+	if _, err = decodeV2Conf(encodedConf); err != errDamagedConf {
+		t.Errorf("Damaged conf was not detected")
+	}
+}
+
+// exampleV2Conf returns a conf, like the one from exampleMetadata, but
+// with SHA-256 checksums and all optional fields.
+func exampleV2Conf() conf {
+	conf := conf{
+		version:        "2",
+		dataLen:        997,
+		dataShardCnt:   5,
+		parityShardCnt: 2,
+		hashAlgorithm:  "sha256",
+		filename:       "example.txt",
+		modified:       1613559315092573491,
+		created:        1613559316000000000,
+	}
+	for i := 0; i < 7; i += 1 {
+		conf.shardHashes = append(conf.shardHashes, fmt.Sprintf("%064x", 360670479+i))
+	}
+	return conf
+}
+
+// appendV2Field appends a field to encodedConf and updates its length
+// and checksum.
+func appendV2Field(encodedConf []byte, tag uint16, value []byte) []byte {
+	b := append([]byte{}, encodedConf[:len(encodedConf)-4]...)
+	b = append(b, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(b[len(b)-6:], tag)
+	binary.BigEndian.PutUint32(b[len(b)-4:], uint32(len(value)))
+	b = append(b, value...)
+	bodyLen := binary.BigEndian.Uint32(b[len(v2ConfMagic):])
+	binary.BigEndian.PutUint32(b[len(v2ConfMagic):], bodyLen+6+uint32(len(value)))
+	checksum := make([]byte, 4)
+	binary.BigEndian.PutUint32(checksum, crc32.Checksum(b, castagnoliTable))
+	return append(b, checksum...)
+}
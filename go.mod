@@ -1,8 +1,11 @@
 module github.com/codesoap/pres
 
-go 1.13
+go 1.18
 
 require (
-	github.com/klauspost/cpuid/v2 v2.0.3 // indirect
+	github.com/klauspost/compress v1.16.7
 	github.com/klauspost/reedsolomon v1.9.11
+	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
 )
+
+require github.com/klauspost/cpuid/v2 v2.0.3 // indirect
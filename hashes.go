@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+// defaultHashAlgorithm is used for the shard checksums of new *.pres
+// files. It is the only algorithm supported by version 1 of the format.
+const defaultHashAlgorithm = "crc32c"
+
+// hashAlgorithms are the supported algorithms for shard checksums.
+var hashAlgorithms = map[string]func() hash.Hash{
+	"crc32c": func() hash.Hash { return crc32.New(castagnoliTable) },
+	"sha256": sha256.New,
+	// Without the key, an attacker cannot recalculate HMAC checksums
+	// for modified data.
+	"hmac-sha256": func() hash.Hash { return hmac.New(sha256.New, hmacKey) },
+}
+
+// hmacKeyFilename is set with -hmac-key. The key is loaded into hmacKey,
+// either from that file or from the PRES_HMAC_KEY environment variable.
+var (
+	hmacKeyFilename string
+	hmacKey         []byte
+)
+
+const hmacKeyEnv = "PRES_HMAC_KEY"
+
+var errNoHMACKey = errors.New("the checksums are keyed, but no key was given")
+
+var errNotKeyed = errors.New("a key was given, but the checksums are not keyed")
+
+var errWrongHMACKey = errors.New("the HMAC key does not match the one of the file")
+
+func isKeyed(algorithm string) bool {
+	return algorithm == "hmac-sha256"
+}
+
+func loadHMACKey() error {
+	if hmacKeyFilename != "" {
+		content, err := ioutil.ReadFile(hmacKeyFilename)
+		if err != nil {
+			return err
+		}
+		// Files written with echo end with a newline:
+		hmacKey = bytes.TrimSuffix(bytes.TrimSuffix(content, []byte("\n")), []byte("\r"))
+	} else if key, ok := os.LookupEnv(hmacKeyEnv); ok {
+		hmacKey = []byte(key)
+	}
+	if hmacKey != nil && len(hmacKey) == 0 {
+		return errors.New("the HMAC key is empty")
+	}
+	return nil
+}
+
+// checkHMACKey checks that the checksums of conf can be calculated with
+// hmacKey, if they are keyed.
+func checkHMACKey(conf conf) error {
+	if !isKeyed(conf.hashAlgorithm) {
+		return nil
+	} else if hmacKey == nil {
+		return errNoHMACKey
+	} else if conf.keyCheck != nil && !hmac.Equal(conf.keyCheck, getKeyCheck()) {
+		return errWrongHMACKey
+	}
+	return nil
+}
+
+// checkKeyed returns errNotKeyed, if hmacKey is set, but the checksums
+// of conf are not keyed with it. Otherwise an attacker could replace
+// keyed checksums with ones, that can be calculated without the key.
+func checkKeyed(conf conf) error {
+	if hmacKey != nil && (!isKeyed(conf.hashAlgorithm) || conf.keyCheck == nil) {
+		return errNotKeyed
+	}
+	return nil
+}
+
+// getKeyCheck returns a value, that identifies hmacKey, without
+// revealing it. It is stored with keyed checksums to detect wrong keys.
+func getKeyCheck() []byte {
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write([]byte("pres key check"))
+	return mac.Sum(nil)[:8]
+}
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// formatSum returns sum as it is stored in conf.shardHashes. CRC32C
+// checksums are decimal numbers, like in version 1 of the format, all
+// others are hexadecimal.
+func formatSum(algorithm string, sum []byte) string {
+	if algorithm == "crc32c" && len(sum) == 4 {
+		return fmt.Sprint(binary.BigEndian.Uint32(sum))
+	}
+	return hex.EncodeToString(sum)
+}
+
+// parseSum is the inverse of formatSum.
+func parseSum(algorithm, s string) ([]byte, error) {
+	if algorithm == "crc32c" {
+		x, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		sum := make([]byte, 4)
+		binary.BigEndian.PutUint32(sum, uint32(x))
+		return sum, nil
+	}
+	return hex.DecodeString(s)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHMACChecksumsNeedTheKey(t *testing.T) {
+	dataFilename, err := createTestInputWithSize(12345)
+	if err != nil {
+		t.Fatalf("Error creating tempfile: %s", err.Error())
+	}
+	defer func() { hashAlgorithm, hmacKey = "", nil }()
+	hashAlgorithm, hmacKey = "hmac-sha256", []byte("secret")
+	createPresFile(dataFilename)
+	presFilename := fmt.Sprint(dataFilename, ".pres")
+	defer os.Remove(presFilename)
+	result, err := checkPresFile(presFilename)
+	if err != nil {
+		t.Fatalf("Error checking *.pres file: %s", err.Error())
+	}
+	if result.conf.hashAlgorithm != "hmac-sha256" || len(result.damagedShards()) > 0 {
+		t.Errorf("Keyed file with %s checksums has damaged shards %v",
+			result.conf.hashAlgorithm, result.damagedShards())
+	}
+
+	hmacKey = []byte("wrong")
+	if _, err = checkPresFile(presFilename); err != errWrongHMACKey {
+		t.Errorf("Checking with the wrong key returned '%v' instead of '%v'", err, errWrongHMACKey)
+	}
+	hmacKey = nil
+	if _, err = checkPresFile(presFilename); err != errNoHMACKey {
+		t.Errorf("Checking without a key returned '%v' instead of '%v'", err, errNoHMACKey)
+	}
+}
+
+func TestDowngradedChecksumsAreRejected(t *testing.T) {
+	dataFilename, err := createTestInputWithSize(12345)
+	if err != nil {
+		t.Fatalf("Error creating tempfile: %s", err.Error())
+	}
+	defer func() { hashAlgorithm, hmacKey = "", nil }()
+	hashAlgorithm, hmacKey = "hmac-sha256", []byte("secret")
+	createPresFile(dataFilename)
+	hashAlgorithm = ""
+	presFilename := fmt.Sprint(dataFilename, ".pres")
+	defer os.Remove(presFilename)
+	result, err := checkPresFile(presFilename)
+	if err != nil {
+		t.Fatalf("Error checking *.pres file: %s", err.Error())
+	}
+
+	// Rewrite the file with CRC32C checksums, like an attacker, who does
+	// not know the key, could.
+	downgradedConf := result.conf
+	downgradedConf.hashAlgorithm = "crc32c"
+	if err = upgrade(presFilename, result, downgradedConf); err != nil {
+		t.Fatalf("Error rewriting *.pres file: %s", err.Error())
+	}
+	report := checkFile(presFilename, false)
+	if report.Result != resultUnkeyed || !strings.HasPrefix(report.Details, errNotKeyed.Error()) {
+		t.Errorf("Checking the downgraded file with the key returned %s: %s", report.Result, report.Details)
+	}
+	if report.ShardsTotal == 0 || report.ShardsIntact != report.ShardsTotal {
+		t.Errorf("The downgraded file has %d of %d intact shards", report.ShardsIntact, report.ShardsTotal)
+	}
+}
+
+func TestHMACKeyFileWithNewline(t *testing.T) {
+	file, err := ioutil.TempFile("", "pres_test_key_*")
+	if err != nil {
+		t.Fatalf("Error creating tempfile: %s", err.Error())
+	}
+	defer os.Remove(file.Name())
+	_, err = file.WriteString("secret\r\n")
+	file.Close()
+	if err != nil {
+		t.Fatalf("Error writing key: %s", err.Error())
+	}
+	defer func() { hmacKeyFilename, hmacKey = "", nil }()
+	hmacKeyFilename = file.Name()
+	if err = loadHMACKey(); err != nil || string(hmacKey) != "secret" {
+		t.Errorf("Loaded key %q, %v instead of \"secret\"", hmacKey, err)
+	}
+}
+
+func TestHMACKeyFromEnvironmentIsUsed(t *testing.T) {
+	defer func() { hashAlgorithm, hmacKey = "", nil }()
+	os.Setenv(hmacKeyEnv, "secret")
+	defer os.Unsetenv(hmacKeyEnv)
+	if err := loadHMACKey(); err != nil {
+		t.Fatalf("Error loading key: %s", err.Error())
+	}
+	flags := flag.NewFlagSet("create", flag.ContinueOnError)
+	addFormatFlags(flags)
+	if err := checkFormatFlags(flags); err != nil {
+		t.Fatalf("Error checking flags: %s", err.Error())
+	}
+	if hashAlgorithm != "hmac-sha256" {
+		t.Errorf("The key from %s chose '%s' checksums", hmacKeyEnv, hashAlgorithm)
+	}
+}
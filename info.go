@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// infoPresFile prints the metadata of a *.pres file. Only the metadata
+// at the end of the file is read, so this is fast, even for huge files.
+func infoPresFile(inFilename string) {
+	result, err := checkConfs(inFilename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading conf sections:", err.Error())
+		os.Exit(2)
+	}
+	if result.intactConfCnt == 0 {
+		fmt.Println("Could not find unharmed conf block.")
+		os.Exit(2)
+	}
+	conf := result.conf
+	shardSize := calculateShardSize(conf.dataLen, conf.dataShardCnt)
+	parityLen := int64(conf.parityShardCnt) * shardSize
+	fmt.Printf("Version:            %s\n", conf.version)
+	fmt.Printf("Data length:        %d bytes\n", conf.dataLen)
+	fmt.Printf("Data shards:        %d\n", conf.dataShardCnt)
+	fmt.Printf("Parity shards:      %d\n", conf.parityShardCnt)
+	fmt.Printf("Shard size:         %d bytes\n", shardSize)
+	fmt.Printf("Parity overhead:    %.2f%%\n", 100*float64(parityLen)/float64(conf.dataLen))
+	fmt.Printf("Hash algorithm:     %s\n", strings.ToUpper(conf.hashAlgorithm))
+	if conf.filename != "" {
+		fmt.Printf("Original filename:  %s\n", conf.filename)
+	}
+	if conf.modified != 0 {
+		fmt.Printf("Modified:           %s\n", formatTime(conf.modified))
+	}
+	if conf.created != 0 {
+		fmt.Printf("Created:            %s\n", formatTime(conf.created))
+	}
+	if conf.signature != nil {
+		fmt.Printf("Signed with key:    %s\n", base64.StdEncoding.EncodeToString(conf.publicKey))
+		fmt.Printf("Data SHA-256:       %s\n", conf.dataSHA256)
+	}
+	if e := conf.encryption; e.isEnabled() {
+		fmt.Printf("Encryption:         %s, key derived with scrypt (N=2^%d, r=%d, p=%d)\n",
+			strings.ToUpper(e.cipher), e.scryptLogN, e.scryptR, e.scryptP)
+		fmt.Printf("Plaintext length:   %d bytes\n", e.plainLen)
+	}
+	if c := conf.compression; c.isEnabled() {
+		fmt.Printf("Compression:        %s\n", strings.ToUpper(c.codec))
+		fmt.Printf("Original length:    %d bytes\n", c.origLen)
+	}
+	if a := conf.archive; a.isEnabled() {
+		fmt.Printf("Archive index:      %d bytes at offset %d\n", a.indexLen, a.indexOffset)
+	}
+	if conf.tarIndex != nil {
+		fmt.Printf("Tar index:          %d bytes\n", len(conf.tarIndex))
+	}
+	fmt.Printf("Intact conf blocks: %d of %d\n", result.intactConfCnt, len(result.confs))
+	for i, c := range result.confs {
+		differences := conf.differences(c)
+		if c.version == "" {
+			fmt.Printf("%s is damaged\n", result.format.confNames[i])
+		} else if len(differences) > 0 {
+			fmt.Printf("%s differs in: %s\n", result.format.confNames[i],
+				strings.Join(differences, ", "))
+		}
+	}
+}
+
+func formatTime(unixNano int64) string {
+	return time.Unix(0, unixNano).Format("2006-01-02 15:04:05 MST")
+}
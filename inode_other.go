@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "os"
+
+// getInode returns 0, because inode numbers are only used on Linux.
+func getInode(info os.FileInfo) uint64 {
+	return 0
+}
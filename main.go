@@ -2,8 +2,10 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"runtime"
 )
 
 // Possible commands
@@ -11,27 +13,132 @@ const (
 	createCommand = iota
 	verifyCommand
 	restoreCommand
+	damageCommand
+	infoCommand
+	upgradeCommand
+	reencodeCommand
+	keygenCommand
+	listCommand
+	extractCommand
+	scrubCommand
+	serveCommand
+	configCommand
 )
 
+// usage lists the commands of getCommand, except for the hidden damage
+// command.
+const usage = "Usage: pres ([c]reate|[v]erify|[r]estore|[i]nfo|upgrade|reencode|list|ls|extract|keygen|scrub|serve|config) [options] <file>"
+
+// workerCnt is the number of shards that are hashed concurrently.
+var workerCnt = runtime.NumCPU()
+
+// dataShardCnt and parityShardCnt are the number of shards, that are
+// used when creating *.pres files. dataShardCnt is reduced for small
+// files.
+var (
+	dataShardCnt   uint8 = 100
+	parityShardCnt uint8 = 3
+)
+
+// formatVersion and hashAlgorithm are set with -format and -hash. If
+// they are empty, create uses the settings or else currentVersion and
+// defaultHashAlgorithm, while upgrade keeps those of the upgraded file.
+var formatVersion, hashAlgorithm string
+
 func main() {
 	command, err := getCommand()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Error when parsing command:", err.Error())
-		fmt.Fprintln(os.Stderr, "Usage: pres ([c]reate|[v]erify|[r]estore) <file>")
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(1)
+	}
+	// The settings change the defaults of the flags.
+	if err = loadSettings(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading settings:", err.Error())
+		os.Exit(1)
+	}
+	flags := getFlagSet(command)
+	if err = flags.Parse(os.Args[2:]); err != nil {
+		os.Exit(1)
+	}
+	if archiveDirname != "" && flags.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "Provide no input file, when archiving a directory with -a")
+		os.Exit(1)
+	} else if command == extractCommand && flags.NArg() == 2 {
+		extractPath = flags.Arg(1)
+	} else if archiveDirname == "" && flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Provide one input file as the last argument")
+		os.Exit(1)
+	}
+	if workerCnt < 1 {
+		fmt.Fprintln(os.Stderr, "The number of workers must be at least 1")
+		os.Exit(1)
+	}
+	if err = setShardCnts(flags); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid shard counts:", err.Error())
+		os.Exit(1)
+	}
+	if err = loadKeys(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading key:", err.Error())
 		os.Exit(1)
 	}
-	if len(os.Args) != 3 {
-		fmt.Fprintln(os.Stderr, "Provide one input file as the second argument")
+	if command == createCommand {
+		if formatVersion == "" {
+			formatVersion = configFormatVersion
+		}
+		if hashAlgorithm == "" {
+			hashAlgorithm = configHashAlgorithm
+		}
+	}
+	if err = checkFormatFlags(flags); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid format:", err.Error())
+		os.Exit(1)
+	}
+	inFilename := flags.Arg(0)
+	if archiveDirname != "" {
+		inFilename = archiveDirname
+	}
+	if (command == damageCommand || command == upgradeCommand || command == reencodeCommand) &&
+		isVolumeFilename(inFilename) {
+		fmt.Fprintln(os.Stderr, "Volumes can only be verified and restored.")
 		os.Exit(1)
 	}
-	inFilename := os.Args[2]
 	switch command {
 	case createCommand:
 		createPresFile(inFilename)
+		if volumeSize > 0 {
+			createVolumes(inFilename)
+		}
 	case verifyCommand:
-		verifyPresFile(inFilename)
+		if verifyRecursive {
+			verifyDirectory(inFilename)
+		} else if jsonOutput {
+			verifyPresFileJSON(inFilename)
+		} else {
+			verifyPresFile(inFilename)
+		}
 	case restoreCommand:
 		restoreData(inFilename)
+	case damageCommand:
+		damagePresFile(inFilename)
+	case infoCommand:
+		infoPresFile(inFilename)
+	case upgradeCommand:
+		upgradePresFile(inFilename)
+	case reencodeCommand:
+		reencodePresFile(inFilename)
+	case keygenCommand:
+		generateKeys(inFilename)
+	case listCommand:
+		listArchive(inFilename)
+	case extractCommand:
+		extractFromArchive(inFilename)
+	case scrubCommand:
+		scrubDirectory(inFilename)
+	case serveCommand:
+		serveDirectory(inFilename)
+	case configCommand:
+		runConfigCommand(inFilename)
 	}
 }
 
@@ -52,7 +159,271 @@ func getCommand() (int, error) {
 		fallthrough
 	case "restore":
 		return restoreCommand, nil
+	case "i":
+		fallthrough
+	case "info":
+		return infoCommand, nil
+	case "upgrade":
+		return upgradeCommand, nil
+	case "reencode":
+		return reencodeCommand, nil
+	case "ls":
+		fallthrough
+	case "list":
+		return listCommand, nil
+	case "extract":
+		return extractCommand, nil
+	case "keygen":
+		return keygenCommand, nil
+	case "scrub":
+		return scrubCommand, nil
+	case "serve":
+		return serveCommand, nil
+	case "config":
+		return configCommand, nil
+	case "damage":
+		return damageCommand, nil
 	default:
 		return -1, errors.New(fmt.Sprint("unknown command ", os.Args[1]))
 	}
 }
+
+func getFlagSet(command int) *flag.FlagSet {
+	flags := flag.NewFlagSet(os.Args[1], flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+	switch command {
+	case createCommand:
+		addShardCntFlags(flags)
+		addFormatFlags(flags)
+		addSignFlag(flags)
+		addHMACKeyFlag(flags)
+		flags.StringVar(&archiveDirname, "a", "",
+			"protect the directory `dir` as an archive, instead of the input file")
+		flags.StringVar(&outFilename, "o", "",
+			"name of the *.pres file (default: <input>.pres)")
+		flags.StringVar(&volumeSizeFlag, "volume-size", "",
+			"split the output into volumes of at most `size` bytes; K, M, G and T suffixes are allowed")
+		flags.BoolVar(&fillVolumes, "fill-volumes", false,
+			"fill volumes up to -volume-size, even if they hold more shards than there are parity shards")
+		flags.BoolVar(&tarMode, "tar", false,
+			"store an index of the members of the tar file given as input")
+		flags.StringVar(&compressCodec, "compress", "",
+			"compress the data with `codec` gzip or zstd before protecting it; the input file is kept")
+		flags.BoolVar(&encryptInput, "encrypt", false,
+			"encrypt the data with AES-256-GCM; the input file is kept")
+		addPassphraseFlag(flags)
+	case verifyCommand:
+		flags.IntVar(&workerCnt, "j", workerCnt,
+			"number of shards to hash concurrently")
+		flags.StringVar(&publicKeyFilename, "pubkey", "",
+			"check that the file is signed with the public key in `file`")
+		flags.BoolVar(&verifyRecursive, "r", false,
+			"verify all *.pres files below the directory given as input")
+		flags.StringVar(&verifySinceFlag, "since", "",
+			"with -r, skip unchanged files, that were verified within `duration`, like 30d")
+		flags.StringVar(&scrubStateFilename, "state", "",
+			"with -r, `file` recording when each file was verified (default: <dir>/.pres_scrub.json)")
+		addMetricsFileFlag(flags)
+		flags.BoolVar(&jsonOutput, "json", jsonOutput,
+			"print the results as JSON")
+		addHMACKeyFlag(flags)
+	case restoreCommand:
+		flags.IntVar(&workerCnt, "j", workerCnt,
+			"number of shards to hash concurrently")
+		addHMACKeyFlag(flags)
+		addPassphraseFlag(flags)
+	case upgradeCommand:
+		addShardCntFlags(flags)
+		addFormatFlags(flags)
+		addSignFlag(flags)
+		addHMACKeyFlag(flags)
+		flags.IntVar(&workerCnt, "j", workerCnt,
+			"number of shards to hash concurrently")
+	case reencodeCommand:
+		addParityShardCntFlag(flags)
+		addSignFlag(flags)
+		addHMACKeyFlag(flags)
+		flags.IntVar(&workerCnt, "j", workerCnt,
+			"number of shards to hash concurrently")
+	case listCommand:
+		addHMACKeyFlag(flags)
+	case extractCommand:
+		flags.StringVar(&extractPath, "path", "",
+			"`path` of the file within the archive, as shown by 'pres list'")
+		flags.StringVar(&outFilename, "o", "",
+			"name of the extracted file (default: the base name of the path)")
+		addHMACKeyFlag(flags)
+	case scrubCommand:
+		flags.BoolVar(&scrubDaemon, "daemon", false,
+			"keep running and verify each file again, once the interval has passed")
+		flags.StringVar(&scrubIntervalFlag, "interval", scrubIntervalFlag,
+			"verify files, that were not verified within `duration`, like 7d or 12h")
+		flags.StringVar(&scrubRateFlag, "rate", "",
+			"read at most `size` bytes per second; K, M, G and T suffixes are allowed")
+		flags.BoolVar(&scrubRepair, "repair", false,
+			"repair damaged files in place")
+		flags.StringVar(&scrubStateFilename, "state", "",
+			"`file` recording when each file was verified (default: <dir>/.pres_scrub.json)")
+		flags.StringVar(&scrubLogFilename, "log", "",
+			"append the results to `file` instead of printing them")
+		addMetricsFileFlag(flags)
+		flags.IntVar(&workerCnt, "j", workerCnt,
+			"number of shards to hash concurrently")
+		addHMACKeyFlag(flags)
+	case serveCommand:
+		flags.StringVar(&listenAddress, "listen", listenAddress,
+			"serve the HTTP API on `address`, like :8080")
+		flags.StringVar(&serveTokenFilename, "token-file", "",
+			"read the bearer token, that clients must send, from `file` (default: $"+serveTokenEnv+")")
+		flags.StringVar(&serveRetentionFlag, "retention", serveRetentionFlag,
+			"remove finished jobs and their restored data after `age`, like 30m or 1d")
+		flags.IntVar(&workerCnt, "j", workerCnt,
+			"number of shards to hash concurrently")
+		addHMACKeyFlag(flags)
+	case damageCommand:
+		flags.IntVar(&damageOpts.bitCnt, "bits", 0,
+			"number of random bits to flip; within the given shard or conf block, if any")
+		flags.IntVar(&damageOpts.shard, "shard", 0,
+			"number of the shard to damage, starting at 1")
+		flags.IntVar(&damageOpts.confCopy, "conf", -1,
+			"index of the conf block to damage (0, 1 or 2)")
+		flags.StringVar(&damageOpts.zeroRange, "zero", "",
+			"set the bytes in `OFFSET:LENGTH` to zero")
+		flags.StringVar(&damageOpts.insertRange, "insert", "",
+			"insert LENGTH random bytes at OFFSET, given as `OFFSET:LENGTH`")
+		flags.Int64Var(&damageOpts.truncateCnt, "truncate", 0,
+			"number of bytes to remove from the end")
+		flags.BoolVar(&damageOpts.inPlace, "in-place", false,
+			"damage the given file instead of a copy")
+		flags.StringVar(&damageOpts.outFilename, "o", "",
+			"name of the damaged copy (default: <name>.damaged.pres)")
+		flags.Int64Var(&damageOpts.seed, "seed", 0,
+			"seed for choosing random bits and bytes (default: random)")
+	}
+	return flags
+}
+
+// The shard counts are parsed as int, because the flag package cannot
+// parse uint8.
+var dataShardCntFlag, parityShardCntFlag int
+
+// dataShardCntGiven and parityShardCntGiven are set, if -data-shards and
+// -parity-shards were given. Otherwise upgrade keeps the shard counts of
+// the upgraded file.
+var dataShardCntGiven, parityShardCntGiven bool
+
+// volumeSizeFlag is parsed into volumeSize.
+var volumeSizeFlag string
+
+func addShardCntFlags(flags *flag.FlagSet) {
+	flags.IntVar(&dataShardCntFlag, "data-shards", int(dataShardCnt),
+		"number of data shards; reduced for small files")
+	addParityShardCntFlag(flags)
+}
+
+func addParityShardCntFlag(flags *flag.FlagSet) {
+	flags.IntVar(&parityShardCntFlag, "parity-shards", int(parityShardCnt),
+		"number of parity shards")
+}
+
+func setShardCnts(flags *flag.FlagSet) error {
+	if flags.Lookup("parity-shards") == nil {
+		return nil
+	}
+	flags.Visit(func(f *flag.Flag) {
+		dataShardCntGiven = dataShardCntGiven || f.Name == "data-shards"
+		parityShardCntGiven = parityShardCntGiven || f.Name == "parity-shards"
+	})
+	if parityShardCntFlag < 1 || parityShardCntFlag >= maxShardCnt {
+		return fmt.Errorf("the number of parity shards must be between 1 and %d",
+			maxShardCnt-1)
+	}
+	parityShardCnt = uint8(parityShardCntFlag)
+	if flags.Lookup("data-shards") == nil {
+		return nil
+	}
+	if dataShardCntFlag < 1 {
+		return errors.New("at least one data shard is needed")
+	}
+	if dataShardCntFlag+parityShardCntFlag > maxShardCnt {
+		return fmt.Errorf("more than %d shards in total are not supported", maxShardCnt)
+	}
+	dataShardCnt = uint8(dataShardCntFlag)
+	return nil
+}
+
+func addFormatFlags(flags *flag.FlagSet) {
+	flags.StringVar(&formatVersion, "format", "",
+		"`version` of the format to write; 2 is chosen if needed (default: 1, or that of the upgraded file)")
+	flags.StringVar(&hashAlgorithm, "hash", "",
+		"checksum `algorithm` of the shards: crc32c, sha256 or hmac-sha256 (default: crc32c,\n"+
+			"hmac-sha256 with -hmac-key or $"+hmacKeyEnv+", or that of the upgraded file)")
+}
+
+func addSignFlag(flags *flag.FlagSet) {
+	flags.StringVar(&signingKeyFilename, "sign", "",
+		"sign the file with the private key in `file`; see 'pres keygen'")
+}
+
+func addHMACKeyFlag(flags *flag.FlagSet) {
+	flags.StringVar(&hmacKeyFilename, "hmac-key", "",
+		"read the key for hmac-sha256 checksums from `file` (default: $"+hmacKeyEnv+")")
+}
+
+func addMetricsFileFlag(flags *flag.FlagSet) {
+	flags.StringVar(&metricsFilename, "metrics-file", "",
+		"write the results as Prometheus metrics to `file`, e.g. for node_exporter's textfile collector")
+}
+
+func addPassphraseFlag(flags *flag.FlagSet) {
+	flags.StringVar(&passphraseFilename, "passphrase-file", "",
+		"read the passphrase for encrypted files from `file` (default: $"+passphraseEnv+")")
+}
+
+func checkFormatFlags(flags *flag.FlagSet) error {
+	if encryptInput && passphrase == nil {
+		return errors.New("-encrypt needs a passphrase")
+	}
+	if err := checkCompressCodec(compressCodec); err != nil {
+		return err
+	}
+	if archiveDirname != "" && encryptInput {
+		return errors.New("archives cannot be encrypted yet")
+	}
+	if volumeSizeFlag != "" {
+		var err error
+		if volumeSize, err = parseSize(volumeSizeFlag); err != nil {
+			return err
+		}
+		if formatVersion == "" {
+			formatVersion = "2"
+		} else if formatVersion != "2" {
+			return errors.New("volumes need version 2 of the format")
+		}
+	}
+	if tarMode && (archiveDirname != "" || compressCodec != "" || encryptInput) {
+		return errors.New("-tar cannot be combined with -a, -compress or -encrypt")
+	}
+	if flags.Lookup("hash") == nil {
+		return nil
+	}
+	// The key may also come from the environment:
+	if hashAlgorithm == "" && hmacKey != nil {
+		hashAlgorithm = "hmac-sha256"
+	}
+	if isKeyed(hashAlgorithm) && hmacKey == nil {
+		return fmt.Errorf("%s checksums need a key", hashAlgorithm)
+	}
+	if formatVersion != "" {
+		if _, err := getFormat(formatVersion); err != nil {
+			return err
+		}
+	}
+	if hashAlgorithm != "" && hashAlgorithms[hashAlgorithm] == nil {
+		return fmt.Errorf("unsupported hash algorithm '%s'", hashAlgorithm)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestUsageListsAllCommands(t *testing.T) {
+	defaultArgs := os.Args
+	defer func() { os.Args = defaultArgs }()
+	commands := usage[strings.Index(usage, "(")+1 : strings.Index(usage, ")")]
+	listed := make(map[int]bool)
+	for _, name := range strings.Split(commands, "|") {
+		names := []string{strings.NewReplacer("[", "", "]", "").Replace(name)}
+		if strings.HasPrefix(name, "[") {
+			names = append(names, name[1:strings.Index(name, "]")])
+		}
+		for _, name := range names {
+			os.Args = []string{"pres", name}
+			command, err := getCommand()
+			if err != nil {
+				t.Errorf("Command '%s' of the usage is unknown: %s", name, err.Error())
+			}
+			listed[command] = true
+		}
+	}
+	for command := createCommand; command <= configCommand; command += 1 {
+		if !listed[command] && command != damageCommand {
+			t.Errorf("Command %d is missing from the usage", command)
+		}
+	}
+}
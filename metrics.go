@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metricsFilename is set with -metrics-file. If it is set, verify and
+// scrub write the results in the text format of Prometheus to it, e.g.
+// for the textfile collector of node_exporter.
+var metricsFilename string
+
+var metricsDescriptions = []struct {
+	name, help string
+	value      func(s *fileState) int64
+}{
+	{"pres_shards_total", "Number of data and parity shards.",
+		func(s *fileState) int64 { return int64(s.ShardsTotal) }},
+	{"pres_shards_intact", "Number of shards matching their checksum.",
+		func(s *fileState) int64 { return int64(s.ShardsIntact) }},
+	{"pres_shards_unreadable", "Number of shards, that could not be read.",
+		func(s *fileState) int64 { return int64(s.ShardsUnreadable) }},
+	{"pres_shards_needed", "Number of intact shards needed to restore the data.",
+		func(s *fileState) int64 { return int64(s.ShardsNeeded) }},
+	{"pres_conf_copies_intact", "Number of intact copies of the metadata.",
+		func(s *fileState) int64 { return int64(s.ConfsIntact) }},
+	{"pres_restorable", "Whether the data can be restored.",
+		func(s *fileState) int64 {
+			if s.restorable() {
+				return 1
+			}
+			return 0
+		}},
+	{"pres_last_verify_timestamp", "Unix time of the last verification.",
+		func(s *fileState) int64 { return s.Verified }},
+}
+
+// metricSeries holds the values of the metrics of files, keyed by the
+// file names and then by the metric names.
+type metricSeries map[string]map[string]int64
+
+func (m metricSeries) add(filename string, s *fileState) {
+	values := make(map[string]int64)
+	for _, d := range metricsDescriptions {
+		values[d.name] = d.value(s)
+	}
+	m[filename] = values
+}
+
+// mergeMetrics merges the metrics of the given files, which are keyed by
+// their names, into metricsFilename. The series of other files are kept,
+// except for those below dirname, if it is not empty: states must then
+// contain all files below dirname, so that the series of removed files
+// disappear.
+func mergeMetrics(states map[string]*fileState, dirname string) error {
+	series, err := readMetricSeries()
+	if err != nil {
+		return err
+	}
+	if dirname != "" {
+		prefix := getMetricsLabel(dirname) + string(filepath.Separator)
+		for label := range series {
+			if strings.HasPrefix(label, prefix) {
+				delete(series, label)
+			}
+		}
+	}
+	for filename, s := range states {
+		series.add(getMetricsLabel(filename), s)
+	}
+	return writeMetricSeries(series)
+}
+
+// getMetricsLabel returns the value of the file label of filename. It is
+// the absolute path, so that verify and scrub use the same label for a
+// file, no matter how it was given.
+func getMetricsLabel(filename string) string {
+	if abs, err := filepath.Abs(filename); err == nil {
+		return abs
+	}
+	return filepath.Clean(filename)
+}
+
+// writeMetricSeries replaces metricsFilename with the given series. The
+// file is replaced atomically, so the collector never reads a partial
+// file.
+func writeMetricSeries(series metricSeries) error {
+	filenames := make([]string, 0, len(series))
+	for filename := range series {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	var b bytes.Buffer
+	for _, d := range metricsDescriptions {
+		fmt.Fprintf(&b, "# HELP %s %s\n", d.name, d.help)
+		fmt.Fprintf(&b, "# TYPE %s gauge\n", d.name)
+		for _, filename := range filenames {
+			if value, ok := series[filename][d.name]; ok {
+				fmt.Fprintf(&b, "%s{file=\"%s\"} %d\n", d.name, escapeLabelValue(filename), value)
+			}
+		}
+	}
+	tmpFile, err := createTempFile(filepath.Dir(metricsFilename), ".pres_metrics_*")
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Write(b.Bytes())
+	if err == nil {
+		err = tmpFile.Chmod(0644)
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), metricsFilename)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+	}
+	return err
+}
+
+// readMetricSeries reads the series of the metrics of pres from
+// metricsFilename, as written by writeMetricSeries. Other lines are
+// ignored and a missing file contains no series.
+func readMetricSeries() (metricSeries, error) {
+	series := make(metricSeries)
+	b, err := ioutil.ReadFile(metricsFilename)
+	if os.IsNotExist(err) {
+		return series, nil
+	} else if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool)
+	for _, d := range metricsDescriptions {
+		known[d.name] = true
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		i := strings.Index(line, `{file="`)
+		j := strings.LastIndex(line, `"} `)
+		if i < 0 || j < i+len(`{file="`) || !known[line[:i]] {
+			continue
+		}
+		value, err := strconv.ParseInt(line[j+len(`"} `):], 10, 64)
+		if err != nil {
+			continue
+		}
+		filename := labelValueUnescaper.Replace(line[i+len(`{file="`) : j])
+		if series[filename] == nil {
+			series[filename] = make(map[string]int64)
+		}
+		series[filename][line[:i]] = value
+	}
+	return series, nil
+}
+
+var (
+	labelValueEscaper   = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	labelValueUnescaper = strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\n`, "\n")
+)
+
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(s)
+}
+
+// exportMetrics merges the metrics of a single verified file into
+// metricsFilename, if it is set; the series of other files are kept.
+// Errors are only reported, so that they do not hide the result of the
+// verification.
+func exportMetrics(filename string, counts fileCounts) {
+	if metricsFilename == "" {
+		return
+	}
+	state := &fileState{Verified: time.Now().Unix(), fileCounts: counts}
+	if err := mergeMetrics(map[string]*fileState{filename: state}, ""); err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing metrics:", err.Error())
+	}
+}
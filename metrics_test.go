@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pres_test_metrics_*")
+	if err != nil {
+		t.Fatalf("Error creating temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer func() { metricsFilename = "" }()
+	metricsFilename = filepath.Join(dir, "pres.prom")
+	states := map[string]*fileState{
+		filepath.Join(dir, `a "b".pres`): {Verified: 1600000000, fileCounts: fileCounts{3, 103, 99, 1, 100}},
+	}
+	if err = mergeMetrics(states, dir); err != nil {
+		t.Fatalf("Error writing metrics: %s", err.Error())
+	}
+	b, err := ioutil.ReadFile(metricsFilename)
+	if err != nil {
+		t.Fatalf("Error reading metrics: %s", err.Error())
+	}
+	label := escapeLabelValue(getMetricsLabel(filepath.Join(dir, `a "b".pres`)))
+	for _, line := range []string{
+		`pres_shards_intact{file="` + label + `"} 99`,
+		`pres_restorable{file="` + label + `"} 0`,
+		`pres_last_verify_timestamp{file="` + label + `"} 1600000000`,
+	} {
+		if !strings.Contains(string(b), line+"\n") {
+			t.Errorf("Metrics do not contain '%s'", line)
+		}
+	}
+}
+
+func TestExportMetricsKeepsOtherFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pres_test_metrics_*")
+	if err != nil {
+		t.Fatalf("Error creating temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer func() { metricsFilename = "" }()
+	metricsFilename = filepath.Join(dir, "pres.prom")
+	exportMetrics(`a "b".pres`, fileCounts{3, 103, 99, 1, 100})
+	exportMetrics("c.pres", fileCounts{3, 103, 103, 0, 100})
+	exportMetrics("./c.pres", fileCounts{3, 103, 102, 0, 100})
+	// Like a scrub of a directory, that contains only d.pres:
+	scrubbed := filepath.Join(dir, "scrubbed")
+	exportMetrics(filepath.Join(scrubbed, "removed.pres"), fileCounts{3, 103, 103, 0, 100})
+	states := map[string]*fileState{
+		filepath.Join(scrubbed, "d.pres"): {fileCounts: fileCounts{3, 103, 101, 0, 100}},
+	}
+	if err = mergeMetrics(states, scrubbed); err != nil {
+		t.Fatalf("Error merging metrics: %s", err.Error())
+	}
+	b, err := ioutil.ReadFile(metricsFilename)
+	if err != nil {
+		t.Fatalf("Error reading metrics: %s", err.Error())
+	}
+	for filename, intact := range map[string]string{
+		`a "b".pres`:                      "99",
+		"c.pres":                          "102",
+		filepath.Join(scrubbed, "d.pres"): "101",
+	} {
+		line := `pres_shards_intact{file="` + escapeLabelValue(getMetricsLabel(filename)) + `"} ` + intact
+		if !strings.Contains(string(b), line+"\n") {
+			t.Errorf("Metrics do not contain '%s'", line)
+		}
+	}
+	if n := strings.Count(string(b), "pres_shards_intact{"); n != 3 {
+		t.Errorf("Got %d series of pres_shards_intact instead of 3", n)
+	}
+}
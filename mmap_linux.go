@@ -0,0 +1,22 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// mmapFile maps the first size bytes of file into memory, read only.
+func mmapFile(file *os.File, size int64) ([]byte, error) {
+	if size <= 0 || int64(int(size)) != size {
+		return nil, errors.New("file size is not suitable for mmap")
+	}
+	return syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func mmapFile(file *os.File, size int64) ([]byte, error) {
+	return nil, errors.New("mmap is not supported on this platform")
+}
+
+func munmap(data []byte) error {
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// reencodePresFile replaces the parity information of a *.pres file with
+// parityShardCnt new parity shards. The data shards are kept as they
+// are, so they must be intact.
+func reencodePresFile(inFilename string) {
+	result, err := checkConfs(inFilename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading conf sections:", err.Error())
+		os.Exit(2)
+	}
+	if result.intactConfCnt == 0 {
+		fmt.Println("Could not find unharmed conf block.")
+		os.Exit(2)
+	}
+	newConf := result.conf
+	resetSignature(&newConf)
+	if newConf.version, err = chooseVersion(newConf, result.conf.version); err != nil {
+		fmt.Fprintln(os.Stderr, "Error choosing the format:", err.Error())
+		os.Exit(1)
+	}
+	newConf.parityShardCnt = parityShardCnt
+	if newConf.shardCnt() > maxShardCnt {
+		fmt.Fprintf(os.Stderr, "More than %d shards in total are not supported.\n",
+			maxShardCnt)
+		os.Exit(1)
+	}
+	fmt.Fprintln(os.Stderr, "Checking shards for damage.")
+	result.shardStates, err = getShardStates(inFilename, result.conf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error calculating hashes:", err.Error())
+		os.Exit(3)
+	}
+	damagedDataShardCnt := 0
+	for _, i := range result.damagedShards() {
+		if i < int(result.conf.dataShardCnt) {
+			damagedDataShardCnt += 1
+		}
+	}
+	if damagedDataShardCnt > 0 {
+		fmt.Println("Reencoding impossible:", damagedDataShardCnt,
+			"data shard(s) is/are damaged. Use 'pres upgrade' to repair them.")
+		os.Exit(4)
+	}
+	if isUpToDate(result, newConf) {
+		fmt.Println("The file is intact and already has", parityShardCnt,
+			"parity shards.")
+		return
+	}
+	warnIfSignatureIsRemoved(result.conf)
+	if err = reencode(inFilename, newConf); err != nil {
+		fmt.Fprintln(os.Stderr, "Error reencoding:", err.Error())
+		os.Exit(3)
+	}
+	fmt.Printf("'%s' now has %d parity shards.\n", inFilename, parityShardCnt)
+}
+
+// reencode writes the data of inFilename, together with newly calculated
+// parity information and metadata, to a temporary file in the same
+// directory and then replaces inFilename with it. The data is copied
+// with io.Copy, which lets the kernel copy it, or even share the blocks
+// on filesystems that support reflinks.
+//
+// Replacing the parity and metadata in place would save the copy, but
+// the new parity must start where the old one does, right behind the
+// data. Until it is completely written, the file would have neither
+// the old nor the new parity and metadata, so a crash would leave the
+// data unprotected and the file unrecognizable. Therefore, without
+// reflinks, reencoding needs as much free space as the file takes up
+// and reads and writes all of it, like upgrade; it only saves passing
+// the data through restore.
+func reencode(inFilename string, newConf conf) error {
+	inFile, err := os.Open(inFilename)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+	stat, err := inFile.Stat()
+	if err != nil {
+		return err
+	}
+	tmpFile, err := createTempFile(filepath.Dir(inFilename), ".pres_reencode_*")
+	if err != nil {
+		return err
+	}
+	// After a successful reencoding, tmpFile no longer exists.
+	defer os.Remove(tmpFile.Name())
+	fmt.Fprintln(os.Stderr, "Copying data.")
+	_, err = io.Copy(tmpFile, io.LimitReader(inFile, newConf.dataLen))
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	hashers := getShardsHashers(newConf)
+	fmt.Fprintln(os.Stderr, "Calculating parity information and checksums.")
+	parityFilenames, err := makeParityFilesAndCalculateHashes(inFilename, newConf, hashers)
+	if err != nil {
+		return err
+	}
+	defer removeFiles(parityFilenames)
+	for i := 0; i < int(newConf.dataShardCnt); i += 1 {
+		if formatSum(newConf.hashAlgorithm, hashers[i].Sum(nil)) != newConf.shardHashes[i] {
+			return fmt.Errorf("data shard %d changed while reencoding", i+1)
+		}
+	}
+	if err = copyOverData(tmpFile.Name(), parityFilenames...); err != nil {
+		return err
+	}
+	if err = writeMetadata(tmpFile.Name(), newConf, hashers); err != nil {
+		return err
+	}
+	newResult, err := checkConfs(tmpFile.Name())
+	if err != nil {
+		return err
+	}
+	if newResult.intactConfCnt != len(confHeaders) {
+		return errors.New("the new metadata is damaged")
+	}
+	return replaceFile(inFilename, tmpFile.Name(), stat.Mode())
+}
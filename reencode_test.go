@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestReencodeReplacesParity(t *testing.T) {
+	dataFilename, err := createTestInputWithSize(5000)
+	if err != nil {
+		t.Fatalf("Error creating tempfile: %s", err.Error())
+	}
+	origFilename := fmt.Sprint(dataFilename, ".orig")
+	defer os.Remove(origFilename)
+	if err = copyFile(dataFilename, origFilename); err != nil {
+		t.Fatalf("Error copying file: %s", err.Error())
+	}
+	createPresFile(dataFilename)
+	presFilename := fmt.Sprint(dataFilename, ".pres")
+	defer os.Remove(presFilename)
+	conf, err := getConf(presFilename)
+	if err != nil {
+		t.Fatalf("Error reading conf: %s", err.Error())
+	}
+	// Damaged parity shards are simply replaced:
+	if err = damageShard(presFilename, conf, int(conf.dataShardCnt)); err != nil {
+		t.Fatalf("Error damaging shard: %s", err.Error())
+	}
+
+	conf.parityShardCnt = 10
+	if err = reencode(presFilename, conf); err != nil {
+		t.Fatalf("Error reencoding: %s", err.Error())
+	}
+	result, err := checkPresFile(presFilename)
+	if err != nil {
+		t.Fatalf("Error checking reencoded file: %s", err.Error())
+	}
+	if result.intactConfCnt != 3 || len(result.damagedShards()) != 0 {
+		t.Errorf("Reencoded file is damaged")
+	}
+	if result.conf.parityShardCnt != 10 {
+		t.Errorf("Reencoded file has %d parity shards instead of 10",
+			result.conf.parityShardCnt)
+	}
+	// Use the new parity to restore the data:
+	for _, i := range spreadShards(result.conf, 10) {
+		if err = damageShard(presFilename, result.conf, i); err != nil {
+			t.Fatalf("Error damaging shard: %s", err.Error())
+		}
+	}
+	if result, err = checkPresFile(presFilename); err != nil {
+		t.Fatalf("Error checking damaged file: %s", err.Error())
+	}
+	err = restore(presFilename, dataFilename, result.shardStates, result.conf)
+	defer os.Remove(dataFilename)
+	if err != nil {
+		t.Fatalf("Error restoring: %s", err.Error())
+	}
+	eq, err := filesAreEqual(origFilename, dataFilename)
+	if err != nil {
+		t.Fatalf("Error comparing files: %s", err.Error())
+	}
+	if !eq {
+		t.Errorf("Restored data does not match the original")
+	}
+}
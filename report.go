@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// jsonOutput is set with -json. verify then prints a fileReport per
+// file as JSON, instead of text.
+var jsonOutput bool
+
+// fileReport is the result of checking a *.pres file. It is printed by
+// verify -json and returned by serve.
+type fileReport struct {
+	File   string `json:"file"`
+	Result string `json:"result"`
+	fileCounts
+	Restorable       bool   `json:"restorable"`
+	DamagedShards    []int  `json:"damaged_shards"` // Numbered from 1; includes the unreadable ones.
+	UnreadableShards []int  `json:"unreadable_shards"`
+	Details          string `json:"details"`
+}
+
+// checkFile verifies a *.pres file and, if repair is set, repairs it in
+// place, if it is damaged. After a repair, the counts of the report
+// describe the repaired file.
+func checkFile(filename string, repair bool) fileReport {
+	report := fileReport{File: filename, DamagedShards: []int{}, UnreadableShards: []int{}}
+	result, err := checkPresFile(filename)
+	if err != nil {
+		report.Result, report.Details = resultFailed, err.Error()
+		return report
+	}
+	report.fileCounts = getFileCounts(result)
+	report.Restorable = result.restorable()
+	for _, i := range result.damagedShards() {
+		report.DamagedShards = append(report.DamagedShards, i+1)
+	}
+	for _, i := range result.unreadableShards() {
+		report.UnreadableShards = append(report.UnreadableShards, i+1)
+	}
+	if result.intactConfCnt == 0 {
+		report.Result, report.Details = resultUnrestorable, "no intact conf block"
+		return report
+	}
+	report.Details = fmt.Sprintf("%d of %d conf blocks and %d of %d shards are intact, %d shard(s) are unreadable",
+		report.ConfsIntact, len(result.confs), report.ShardsIntact, report.ShardsTotal, report.ShardsUnreadable)
+	if !result.restorable() {
+		report.Result = resultUnrestorable
+	} else if err = checkKeyed(result.conf); err != nil {
+		// The unkeyed checksums may have been written by an attacker, so
+		// they are neither trusted nor rewritten by a repair.
+		report.Result = resultUnkeyed
+		report.Details = fmt.Sprintf("%s; %s", err.Error(), report.Details)
+	} else if result.intactConfCnt == len(result.confs) && len(result.damagedShards()) == 0 {
+		report.Result = resultIntact
+	} else if !repair {
+		report.Result = resultDamaged
+	} else if err = upgrade(filename, result, result.conf); err != nil {
+		// Rewriting the file with its own conf repairs it, without
+		// changing the metadata or invalidating the signature.
+		report.Result = resultDamaged
+		report.Details = fmt.Sprintf("%s; repairing failed: %s", report.Details, err.Error())
+	} else {
+		report.Result = resultRepaired
+		report.ConfsIntact, report.ShardsIntact, report.ShardsUnreadable = len(result.confs), report.ShardsTotal, 0
+	}
+	return report
+}
+
+// verifyPresFileJSON is verify with -json for a single file.
+func verifyPresFileJSON(inFilename string) {
+	if publicKey != nil {
+		fmt.Fprintln(os.Stderr, "Signatures cannot be checked with -json.")
+		os.Exit(1)
+	}
+	if isVolumeFilename(inFilename) {
+		checkVolumesOrExit(inFilename)
+	}
+	report := checkFile(inFilename, false)
+	if report.Result != resultFailed {
+		exportMetrics(inFilename, report.fileCounts)
+	}
+	json.NewEncoder(os.Stdout).Encode(report)
+	if report.Result == resultFailed {
+		os.Exit(3)
+	} else if report.Result == resultUnrestorable {
+		os.Exit(4)
+	} else if report.Result == resultUnkeyed {
+		os.Exit(7)
+	}
+}
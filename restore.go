@@ -1,9 +1,9 @@
 package main
 
 import (
+	"crypto/cipher"
 	"errors"
 	"fmt"
-	"github.com/klauspost/reedsolomon"
 	"io"
 	"io/ioutil"
 	"os"
@@ -25,178 +25,266 @@ func restoreData(inFilename string) {
 		fmt.Fprintf(os.Stderr, "'%s' already exists.\n", outFilename)
 		os.Exit(1)
 	}
-	fmt.Fprintln(os.Stderr, "Checking shards for damage.")
+	if isVolumeFilename(inFilename) {
+		checkVolumesOrExit(inFilename)
+	}
 	conf, err := getConf(inFilename)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Error reading *.pres file:", err.Error())
 		os.Exit(2)
 	}
-	shardStates, err := getShardStates(inFilename, conf)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error reading *.pres file:", err.Error())
-		os.Exit(2)
+	if err = checkKeyed(conf); err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot authenticate: a key was given, but the checksums are not keyed with it.")
+		os.Exit(7)
 	}
-	fmt.Fprintln(os.Stderr, "Restoring damaged shards.")
-	restoredShards, err := restore(inFilename, shardStates, conf)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error restoring damaged shards:", err.Error())
-		os.Exit(3)
+	// With a missing or wrong key, every shard would look damaged:
+	if err = checkHMACKey(conf); err == errNoHMACKey {
+		fmt.Fprintln(os.Stderr, "Keyed file: the checksums need the key, given with -hmac-key or in",
+			hmacKeyEnv+".")
+		os.Exit(6)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "Wrong HMAC key: the checksums were calculated with a different key.")
+		os.Exit(6)
 	}
-	fmt.Fprintln(os.Stderr, "Verifying restored data.")
-	err = verify(inFilename, restoredShards, conf)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error verifying restored shards:", err.Error())
-		os.Exit(4)
+	if conf.encryption.isEnabled() && passphrase == nil {
+		fmt.Fprintf(os.Stderr, "The data is encrypted; give the passphrase with -passphrase-file or in %s.\n",
+			passphraseEnv)
+		os.Exit(1)
 	}
-	fmt.Fprintf(os.Stderr, "Writing '%s'.\n", outFilename)
-	err = writeOutput(inFilename, restoredShards, conf)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error writing output:", err.Error())
-		os.Exit(5)
+	fmt.Fprintf(os.Stderr, "Restoring data to '%s'.\n", outFilename)
+	if err = restoreAny(inFilename, outFilename, nil, conf, passphrase); err != nil {
+		fmt.Fprintln(os.Stderr, "Error restoring data:", err.Error())
+		os.Exit(3)
 	}
-	if err = removeFiles(restoredShards); err != nil {
-		fmt.Fprintln(os.Stderr, "Error removing temporary files:", err.Error())
-		os.Exit(6)
+}
+
+// restoreAny restores an archive, encrypted or compressed data or plain
+// data to outFilename. passphrase is only needed for encrypted data.
+// shardStates may be nil, like for restore.
+func restoreAny(inFilename, outFilename string, shardStates []bool, conf conf, passphrase []byte) error {
+	if conf.archive.isEnabled() {
+		return restoreArchive(inFilename, outFilename, shardStates, conf)
+	} else if conf.encryption.isEnabled() || conf.compression.isEnabled() {
+		return restoreAndDecode(inFilename, outFilename, shardStates, conf, passphrase)
 	}
+	return restore(inFilename, outFilename, shardStates, conf)
 }
 
 func getConf(inFilename string) (conf, error) {
-	confs, err := readConfs(inFilename)
+	result, err := checkConfs(inFilename)
 	if err != nil {
-		var dummy conf
-		return dummy, err
+		return result.conf, err
 	}
-	correctConfs := getCorrectConfs(confs)
-	if len(correctConfs) == 0 {
-		var dummy conf
-		return dummy, errors.New("could not find unharmed conf block")
+	if result.intactConfCnt == 0 {
+		return result.conf, errors.New("could not find unharmed conf block")
 	}
-	return correctConfs[0], nil
+	return result.conf, nil
 }
 
-func getShardStates(inFilename string, conf conf) ([]bool, error) {
-	generatedHashes, err := generateHashes(inFilename, conf)
-	if err != nil {
-		return nil, err
-	}
-	shardStates := make([]bool, conf.dataShardCnt+conf.parityShardCnt)
-	for i, hash := range conf.shardCRC32Cs {
-		if hash == generatedHashes[i] {
-			shardStates[i] = intact
+// restoreAndDecode restores the encrypted or compressed data and
+// decrypts and decompresses it to outFilename on the fly.
+func restoreAndDecode(inFilename, outFilename string, shardStates []bool, conf conf, passphrase []byte) error {
+	var aead cipher.AEAD
+	if conf.encryption.isEnabled() {
+		var err error
+		if aead, err = conf.encryption.newAEAD(passphrase); err != nil {
+			return err
 		}
 	}
-	return shardStates, nil
+	return restoreWith(inFilename, outFilename, shardStates, conf, func(w io.Writer, r io.Reader) error {
+		return decode(w, r, aead, conf)
+	})
 }
 
-func restore(inFilename string, shardStates []bool, conf conf) ([]string, error) {
-	readers, files, err := getShardReaders(inFilename, conf)
-	if err != nil {
-		return nil, err
-	}
-	defer func() {
-		for _, file := range files {
-			file.Close()
-		}
-	}()
-	i := conf.dataShardCnt - 1
-	readers[i] = fillLastDataReader(readers[i], conf.dataShardCnt, conf.dataLen)
-	outFilenames := make([]string, len(readers))
-	writers := make([]io.Writer, len(readers))
-	for i, shardState := range shardStates {
-		if shardState == damaged {
-			readers[i] = nil
-			outFile, err := ioutil.TempFile("", "pres_restored_shard_*")
-			if err != nil {
-				return nil, err
-			}
-			defer outFile.Close()
-			outFilenames[i] = outFile.Name()
-			writers[i] = outFile
+// decode decrypts and decompresses the data from r to w.
+func decode(w io.Writer, r io.Reader, aead cipher.AEAD, conf conf) error {
+	if conf.encryption.isEnabled() {
+		fmt.Fprintln(os.Stderr, "Decrypting data.")
+		if !conf.compression.isEnabled() {
+			return conf.encryption.decrypt(w, r, aead)
 		}
+		ciphertext := r
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go func() {
+			pw.CloseWithError(conf.encryption.decrypt(pw, ciphertext, aead))
+		}()
+		r = pr
 	}
-	dataShardCnt := int(conf.dataShardCnt)
-	parityShardCnt := int(conf.parityShardCnt)
-	enc, err := reedsolomon.NewStream(dataShardCnt, parityShardCnt)
-	if err != nil {
-		return nil, err
-	}
-	err = enc.Reconstruct(readers, writers)
-	return outFilenames, err
+	fmt.Fprintln(os.Stderr, "Decompressing data.")
+	return conf.compression.decompress(w, r)
+}
+
+// restore writes the data to outFilename. If shardStates is nil, all
+// shards are assumed to be intact, so the data is usually read only once;
+// only if a shard turns out to be damaged, all shards are checked and the
+// data is restored again.
+func restore(inFilename, outFilename string, shardStates []bool, conf conf) error {
+	return restoreWith(inFilename, outFilename, shardStates, conf, nil)
 }
 
-func verify(inFilename string, restoredShards []string, conf conf) error {
-	readers, files, err := getRestoredReaders(inFilename, restoredShards, conf)
+// restoreWith is like restore, but if decode is not nil, the data is
+// streamed through it on its way to outFilename. A new outFilename gets
+// the permissions of the *.pres file.
+func restoreWith(inFilename, outFilename string, shardStates []bool, conf conf,
+	decode func(w io.Writer, r io.Reader) error) error {
+	file, err := openShards(inFilename)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		for _, file := range files {
-			file.Close()
-		}
-	}()
-	dataShardCnt := int(conf.dataShardCnt)
-	parityShardCnt := int(conf.parityShardCnt)
-	enc, err := reedsolomon.NewStream(dataShardCnt, parityShardCnt)
+	defer file.Close()
+	mode := os.FileMode(0666)
+	if stat, err := os.Stat(inFilename); err == nil {
+		mode = stat.Mode().Perm()
+	}
+	outFile, err := os.OpenFile(outFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
 	if err != nil {
 		return err
 	}
-	isOK, err := enc.Verify(readers)
-	if !isOK {
-		return errors.New("parity shards contain wrong data")
+	write := func(shardStates []bool) error {
+		if decode == nil {
+			return writeData(outFile, file, shardStates, conf)
+		}
+		return pipeData(file, shardStates, conf, func(r io.Reader) error {
+			return decode(outFile, r)
+		})
+	}
+	reset := func() error {
+		if err := outFile.Truncate(0); err != nil {
+			return err
+		}
+		_, err := outFile.Seek(0, io.SeekStart)
+		return err
+	}
+	err = restoreTo(inFilename, shardStates, conf, write, reset)
+	if closeErr := outFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(outFilename)
 	}
 	return err
 }
 
-func writeOutput(inFilename string, restoredShards []string, conf conf) error {
-	readers, files, err := getRestoredReaders(inFilename, restoredShards, conf)
-	if err != nil {
-		return err
+// restoreTo calls write with shardStates or, if they are nil, with all
+// shards assumed to be intact. If that fails because of damage, the
+// actual shard states are determined, the output is discarded with reset
+// and write is called again. Errors while writing the output are
+// returned directly.
+func restoreTo(inFilename string, shardStates []bool, conf conf, write func([]bool) error, reset func() error) error {
+	if shardStates != nil {
+		return write(shardStates)
 	}
-	defer func() {
-		for _, file := range files {
-			file.Close()
-		}
-	}()
-	dataShardCnt := int(conf.dataShardCnt)
-	parityShardCnt := int(conf.parityShardCnt)
-	enc, err := reedsolomon.NewStream(dataShardCnt, parityShardCnt)
-	if err != nil {
+	shardStates = make([]bool, conf.shardCnt())
+	for i := range shardStates {
+		shardStates[i] = intact
+	}
+	err := write(shardStates)
+	if err == nil || isOutputError(err) {
 		return err
 	}
-	outFilename, err := getDataOutFilename(inFilename)
-	if err != nil {
+	fmt.Fprintf(os.Stderr, "Found damage (%s); checking all shards.\n", err.Error())
+	if shardStates, err = getShardStates(inFilename, conf); err != nil {
 		return err
 	}
-	outFile, err := os.Create(outFilename)
-	if err != nil {
+	if err = reset(); err != nil {
 		return err
 	}
-	defer outFile.Close()
-	var writer io.Writer = outFile
-	return enc.Join(writer, readers, conf.dataLen)
+	fmt.Fprintln(os.Stderr, "Restoring data again.")
+	return write(shardStates)
 }
 
-func getRestoredReaders(inFilename string, restoredShards []string, conf conf) ([]io.Reader, []*os.File, error) {
-	readers, files, err := getShardReaders(inFilename, conf)
-	if err != nil {
-		return nil, nil, err
-	}
-	i := conf.dataShardCnt - 1
-	readers[i] = fillLastDataReader(readers[i], conf.dataShardCnt, conf.dataLen)
-	for i, restoredShard := range restoredShards {
-		if restoredShard != "" {
-			file, err := os.Open(restoredShard)
-			if err != nil {
-				return nil, nil, err
+// isOutputError reports whether err is an error of the file system, like
+// a full disk or missing permissions. While restoring, such errors only
+// come from writing the output, because shards, that cannot be read, are
+// treated as damaged instead.
+func isOutputError(err error) bool {
+	var pathErr *os.PathError
+	var linkErr *os.LinkError
+	var syscallErr *os.SyscallError
+	return errors.As(err, &pathErr) || errors.As(err, &linkErr) || errors.As(err, &syscallErr)
+}
+
+// pipeData streams the data through an io.Pipe into consume.
+func pipeData(file io.ReaderAt, shardStates []bool, conf conf, consume func(r io.Reader) error) error {
+	pr, pw := io.Pipe()
+	consumed := make(chan error, 1)
+	go func() {
+		err := consume(pr)
+		if err == nil {
+			// All data shards must still be checked, even if consume did
+			// not need all of the data.
+			_, err = io.Copy(ioutil.Discard, pr)
+		}
+		pr.CloseWithError(err)
+		consumed <- err
+	}()
+	err := writeData(pw, file, shardStates, conf)
+	pw.CloseWithError(err)
+	if consumeErr := <-consumed; err == nil {
+		err = consumeErr
+	}
+	return err
+}
+
+// writeData writes the data to w in order, one data shard after the
+// other. Intact data shards are read directly; the stripes of damaged
+// ones are reconstructed from the other shards. A shard, that cannot be
+// read, is treated as an erasure from then on. Every data shard is
+// compared with its checksum after it was written. The stripes of
+// damaged shards are at most reconstructStripeSize bytes long, so about
+// reconstructStripeSize*(dataShardCnt+parityShardCnt) bytes of memory are
+// needed, independent of the file size. The reconstructed stripes of the
+// damaged data shards behind the current one are kept in a temporary
+// file, which can grow to the size of these shards.
+func writeData(w io.Writer, file io.ReaderAt, shardStates []bool, conf conf) error {
+	shardStates = append([]bool(nil), shardStates...)
+	shardSize := calculateShardSize(conf.dataLen, conf.dataShardCnt)
+	buf := make([]byte, min64(readAheadSize, shardSize))
+	hasher := hashAlgorithms[conf.hashAlgorithm]()
+	var reconstructor *stripeReconstructor
+	for i := 0; i < int(conf.dataShardCnt); i += 1 {
+		offset, size := getShardBounds(conf, i)
+		hasher.Reset()
+		for stripeOffset := int64(0); stripeOffset < size; stripeOffset += readAheadSize {
+			stripe := buf[:min64(readAheadSize, size-stripeOffset)]
+			if shardStates[i] == intact {
+				if err := readFull(file, stripe, offset+stripeOffset); err != nil {
+					fmt.Fprintf(os.Stderr, "Shard %d is unreadable: %s\n", i+1, err.Error())
+					shardStates[i] = damaged
+				}
+			}
+			if shardStates[i] == damaged {
+				var err error
+				if reconstructor == nil {
+					if reconstructor, err = newStripeReconstructor(conf); err != nil {
+						return err
+					}
+					defer reconstructor.close()
+				}
+				for k := int64(0); k < int64(len(stripe)); k += reconstructStripeSize {
+					part := stripe[k:min64(k+reconstructStripeSize, int64(len(stripe)))]
+					if err = reconstructor.reconstruct(file, shardStates, offset+stripeOffset+k, part); err != nil {
+						return err
+					}
+				}
 			}
-			files = append(files, file)
-			readers[i] = file
+			hasher.Write(stripe)
+			if _, err := w.Write(stripe); err != nil {
+				return err
+			}
+		}
+		if formatSum(conf.hashAlgorithm, hasher.Sum(nil)) != conf.shardHashes[i] {
+			return fmt.Errorf("shard %d does not match its checksum", i+1)
 		}
 	}
-	return readers, files, nil
+	return nil
 }
 
 func getDataOutFilename(inFilename string) (string, error) {
+	if isVolumeFilename(inFilename) {
+		inFilename = volumeSuffix.ReplaceAllString(inFilename, "")
+	}
 	if !strings.HasSuffix(inFilename, ".pres") {
 		return "", errors.New("input file does not have .pres suffix")
 	}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// unreadableReaderAt fails like a disk with unreadable sectors, when
+// reading from the range [start, end).
+type unreadableReaderAt struct {
+	r          io.ReaderAt
+	start, end int64
+}
+
+func (u unreadableReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < u.end && off+int64(len(p)) > u.start {
+		return 0, &os.PathError{Op: "read", Path: "test", Err: syscall.EIO}
+	}
+	return u.r.ReadAt(p, off)
+}
+
+func TestUnreadableShardIsRestored(t *testing.T) {
+	dataFilename, err := createTestInputWithSize(100000)
+	if err != nil {
+		t.Fatalf("Error creating tempfile: %s", err.Error())
+	}
+	defer os.Remove(dataFilename)
+	original, err := ioutil.ReadFile(dataFilename)
+	if err != nil {
+		t.Fatalf("Error reading input: %s", err.Error())
+	}
+	createPresFile(dataFilename)
+	presFilename := fmt.Sprint(dataFilename, ".pres")
+	defer os.Remove(presFilename)
+	conf, err := getConf(presFilename)
+	if err != nil {
+		t.Fatalf("Error reading conf: %s", err.Error())
+	}
+	presFile, err := os.Open(presFilename)
+	if err != nil {
+		t.Fatalf("Error opening *.pres file: %s", err.Error())
+	}
+	defer presFile.Close()
+	offset, size := getShardBounds(conf, 1)
+	file := unreadableReaderAt{presFile, offset + size/2, offset + size/2 + 1}
+
+	hashes, readErrs := generateHashesFromReaders(newShardReaders(file, conf, conf.shardCnt()), conf)
+	for i, err := range readErrs {
+		if (err != nil) != (i == 1) {
+			t.Errorf("Read error of shard %d is %v", i+1, err)
+		} else if err == nil && hashes[i] != conf.shardHashes[i] {
+			t.Errorf("Hash of shard %d is wrong", i+1)
+		}
+	}
+
+	// Pretend the shard became unreadable after it was checked:
+	shardStates := make([]bool, conf.shardCnt())
+	for i := range shardStates {
+		shardStates[i] = intact
+	}
+	var restored bytes.Buffer
+	if err = writeData(&restored, file, shardStates, conf); err != nil {
+		t.Fatalf("Error restoring: %s", err.Error())
+	}
+	if !bytes.Equal(restored.Bytes(), original) {
+		t.Errorf("The restored data differs from the original")
+	}
+}
+
+func TestDamageIsFoundWhileRestoring(t *testing.T) {
+	dataFilename, err := createTestInputWithSize(100000)
+	if err != nil {
+		t.Fatalf("Error creating tempfile: %s", err.Error())
+	}
+	defer os.Remove(dataFilename)
+	original, err := ioutil.ReadFile(dataFilename)
+	if err != nil {
+		t.Fatalf("Error reading input: %s", err.Error())
+	}
+	createPresFile(dataFilename)
+	presFilename := fmt.Sprint(dataFilename, ".pres")
+	defer os.Remove(presFilename)
+	conf, err := getConf(presFilename)
+	if err != nil {
+		t.Fatalf("Error reading conf: %s", err.Error())
+	}
+	for _, i := range []int{2, int(conf.dataShardCnt)} {
+		if err = damageShard(presFilename, conf, i); err != nil {
+			t.Fatalf("Error damaging shard %d: %s", i+1, err.Error())
+		}
+	}
+	// Without known shard states, the damage is only found while restoring.
+	if err = restore(presFilename, dataFilename, nil, conf); err != nil {
+		t.Fatalf("Error restoring: %s", err.Error())
+	}
+	if restored, _ := ioutil.ReadFile(dataFilename); !bytes.Equal(restored, original) {
+		t.Errorf("The restored data differs from the original")
+	}
+}
+
+// countingReaderAt counts the bytes, that are read from r.
+type countingReaderAt struct {
+	r io.ReaderAt
+	n int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.n += int64(n)
+	return n, err
+}
+
+func TestDamagedShardsAreReconstructedOnce(t *testing.T) {
+	dataFilename, err := createTestInputWithSize(100000)
+	if err != nil {
+		t.Fatalf("Error creating tempfile: %s", err.Error())
+	}
+	defer os.Remove(dataFilename)
+	original, err := ioutil.ReadFile(dataFilename)
+	if err != nil {
+		t.Fatalf("Error reading input: %s", err.Error())
+	}
+	createPresFile(dataFilename)
+	presFilename := fmt.Sprint(dataFilename, ".pres")
+	defer os.Remove(presFilename)
+	conf, err := getConf(presFilename)
+	if err != nil {
+		t.Fatalf("Error reading conf: %s", err.Error())
+	}
+	presFile, err := os.Open(presFilename)
+	if err != nil {
+		t.Fatalf("Error opening *.pres file: %s", err.Error())
+	}
+	defer presFile.Close()
+	shardStates := make([]bool, conf.shardCnt())
+	for i := range shardStates {
+		shardStates[i] = intact
+	}
+	shardStates[0], shardStates[1] = damaged, damaged
+	file := &countingReaderAt{r: presFile}
+	var restored bytes.Buffer
+	if err = writeData(&restored, file, shardStates, conf); err != nil {
+		t.Fatalf("Error restoring: %s", err.Error())
+	}
+	if !bytes.Equal(restored.Bytes(), original) {
+		t.Errorf("The restored data differs from the original")
+	}
+	shardSize := calculateShardSize(conf.dataLen, conf.dataShardCnt)
+	// Every shard is read once for reconstructing and the intact data
+	// shards once more for writing them:
+	if maxRead := int64(conf.shardCnt()+int(conf.dataShardCnt)) * shardSize; file.n > maxRead {
+		t.Errorf("Read %d bytes to restore, instead of at most %d", file.n, maxRead)
+	}
+}
+
+func BenchmarkRestore(b *testing.B) {
+	presFilename := createBenchPresFile(b, *benchSize)
+	defer os.Remove(presFilename)
+	conf, err := getConf(presFilename)
+	if err != nil {
+		b.Fatalf("Error reading conf: %s", err.Error())
+	}
+	shardStates := make([]bool, conf.shardCnt())
+	for i := 1; i < len(shardStates); i += 1 {
+		shardStates[i] = intact
+	}
+	outFilename, _ := getDataOutFilename(presFilename)
+	defaultUseMmap := useMmap
+	defer func() { useMmap = defaultUseMmap }()
+	for _, mmap := range []bool{true, false} {
+		b.Run(benchReadMode(mmap), func(b *testing.B) {
+			useMmap = mmap
+			b.SetBytes(conf.dataLen)
+			for i := 0; i < b.N; i += 1 {
+				err := restore(presFilename, outFilename, shardStates, conf)
+				if err != nil {
+					b.Fatalf("Error restoring: %s", err.Error())
+				}
+			}
+			os.Remove(outFilename)
+		})
+	}
+}
+
+func TestOutputErrorsAreNotDamage(t *testing.T) {
+	c := conf{dataShardCnt: 2, parityShardCnt: 1}
+	outputErr := &os.PathError{Op: "write", Path: "out", Err: syscall.ENOSPC}
+	write := func([]bool) error { return fmt.Errorf("writing failed: %w", outputErr) }
+	reset := func() error {
+		t.Errorf("The output was reset after an error while writing it")
+		return nil
+	}
+	if err := restoreTo("missing.pres", nil, c, write, reset); !errors.Is(err, outputErr) {
+		t.Errorf("Restoring returned '%v' instead of '%v'", err, outputErr)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Options of the scrub command. The string flags are parsed by
+// parseScrubFlags.
+var (
+	scrubDaemon        bool
+	scrubRepair        bool
+	scrubStateFilename string
+	scrubLogFilename   string
+	scrubIntervalFlag  = "7d"
+	scrubRateFlag      string
+	scrubInterval      time.Duration
+)
+
+// The results of scrubbing a *.pres file, as stored in the state file.
+const (
+	resultIntact       = "intact"
+	resultDamaged      = "damaged"
+	resultRepaired     = "repaired"
+	resultUnrestorable = "unrestorable"
+	resultUnkeyed      = "unkeyed" // The checksums are not keyed with the given HMAC key.
+	resultFailed       = "failed"
+)
+
+// scrubDirectory verifies all *.pres files below dirname, that were not
+// verified within scrubInterval, according to the state file. With
+// scrubDaemon, it does so repeatedly and never returns.
+func scrubDirectory(dirname string) {
+	if err := parseScrubFlags(); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid option:", err.Error())
+		os.Exit(1)
+	}
+	if scrubStateFilename == "" {
+		scrubStateFilename = filepath.Join(dirname, ".pres_scrub.json")
+	}
+	var log io.Writer = os.Stdout
+	if scrubLogFilename != "" {
+		logFile, err := os.OpenFile(scrubLogFilename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error opening log:", err.Error())
+			os.Exit(1)
+		}
+		defer logFile.Close()
+		log = logFile
+	}
+	for {
+		counts, next, err := scrubPass(dirname, log)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error scrubbing:", err.Error())
+			if !scrubDaemon {
+				os.Exit(2)
+			}
+		}
+		if !scrubDaemon {
+			os.Exit(getScrubExitStatus(counts))
+		}
+		// Look for new files at least once an hour. Files, that were due,
+		// but could not be checked, must not make the loop spin.
+		delay := time.Hour
+		if !next.IsZero() && time.Until(next) < delay {
+			delay = time.Until(next)
+		}
+		if delay < time.Minute {
+			delay = time.Minute
+		}
+		time.Sleep(delay)
+	}
+}
+
+// verifyRecursive and verifySinceFlag are set with the -r and -since
+// options of verify.
+var (
+	verifyRecursive bool
+	verifySinceFlag string
+)
+
+// verifyDirectory verifies all *.pres files below dirname, like a single
+// pass of scrub without repairs. With -since, files, that were verified
+// within the given time and have not changed since, are skipped.
+func verifyDirectory(dirname string) {
+	if publicKey != nil {
+		fmt.Fprintln(os.Stderr, "Signatures cannot be checked with -r.")
+		os.Exit(1)
+	}
+	if verifySinceFlag != "" {
+		var err error
+		if scrubInterval, err = parseAge(verifySinceFlag); err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid option:", err.Error())
+			os.Exit(1)
+		}
+	}
+	if scrubStateFilename == "" {
+		scrubStateFilename = filepath.Join(dirname, ".pres_scrub.json")
+	}
+	counts, _, err := scrubPass(dirname, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error verifying:", err.Error())
+		os.Exit(2)
+	}
+	os.Exit(getScrubExitStatus(counts))
+}
+
+// getScrubExitStatus returns the exit status for the number of files per
+// result of a pass: 3, if a file could not be checked, 4, if a file is
+// unrestorable, 7, if the checksums of a file are not keyed with the
+// given HMAC key, 8, if a file is damaged, and 0 otherwise.
+func getScrubExitStatus(counts map[string]int) int {
+	if counts[resultFailed] > 0 {
+		return 3
+	} else if counts[resultUnrestorable] > 0 {
+		return 4
+	} else if counts[resultUnkeyed] > 0 {
+		return 7
+	} else if counts[resultDamaged] > 0 {
+		return 8
+	}
+	return 0
+}
+
+func parseScrubFlags() error {
+	var err error
+	if scrubInterval, err = parseAge(scrubIntervalFlag); err != nil {
+		return err
+	}
+	if scrubRateFlag != "" {
+		rate, err := parseSize(scrubRateFlag)
+		if err != nil {
+			return err
+		}
+		readLimiter = &rateLimiter{rate: rate}
+	}
+	return nil
+}
+
+// parseAge parses durations like 30d, 12h or 90m.
+func parseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseInt(strings.TrimSuffix(s, "d"), 10, 64)
+		if err != nil || days <= 0 || days > 100000 {
+			return 0, fmt.Errorf("invalid duration '%s'", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration '%s'", s)
+	}
+	return d, nil
+}
+
+// scrubPass verifies the *.pres files below dirname, that are due, and
+// writes a line per file and a summary to log. The state file is saved
+// after each file. The number of files per result, including the last
+// results of the files, that were not due, and the time, when the next
+// file is due, are returned.
+func scrubPass(dirname string, log io.Writer) (map[string]int, time.Time, error) {
+	counts := make(map[string]int)
+	state, err := loadScrubState(scrubStateFilename)
+	if err != nil {
+		return counts, time.Time{}, err
+	}
+	relFilenames, unreadable, err := findPresFiles(dirname)
+	if err != nil {
+		return counts, time.Time{}, err
+	}
+	found := make(map[string]bool)
+	for _, relFilename := range relFilenames {
+		found[relFilename] = true
+	}
+	// The state of files, that could not be read this time, is kept:
+	for relFilename := range state.Files {
+		if !found[relFilename] && !isBelowAny(relFilename, unreadable) {
+			delete(state.Files, relFilename)
+		}
+	}
+	checkedCnt := 0
+	for _, relFilename := range relFilenames {
+		filename := filepath.Join(dirname, filepath.FromSlash(relFilename))
+		info, err := os.Stat(filename)
+		if err != nil {
+			continue
+		} else if s := state.Files[relFilename]; !s.isDue(info, scrubInterval) {
+			counts[s.Result] += 1
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "Checking '%s'.\n", filename)
+		report := checkFile(filename, scrubRepair)
+		report.File = relFilename
+		counts[report.Result] += 1
+		checkedCnt += 1
+		if report.Result == resultRepaired {
+			if info, err = os.Stat(filename); err != nil {
+				return counts, time.Time{}, err
+			}
+		}
+		state.Files[relFilename] = newFileState(report.Result, report.fileCounts, info)
+		if jsonOutput {
+			json.NewEncoder(log).Encode(report)
+		} else {
+			fmt.Fprintf(log, "%s %s '%s': %s\n", time.Now().Format(time.RFC3339), report.Result,
+				relFilename, report.Details)
+		}
+		if err = state.save(scrubStateFilename); err != nil {
+			return counts, time.Time{}, err
+		}
+	}
+	if !jsonOutput && (checkedCnt > 0 || !scrubDaemon) {
+		fmt.Fprintf(log, "%s Checked %d of %d file(s). Last results: %d intact, %d repaired, %d damaged, %d unrestorable, %d unkeyed, %d failed.\n",
+			time.Now().Format(time.RFC3339), checkedCnt, len(relFilenames), counts[resultIntact],
+			counts[resultRepaired], counts[resultDamaged], counts[resultUnrestorable], counts[resultUnkeyed],
+			counts[resultFailed])
+	}
+	if metricsFilename != "" {
+		states := make(map[string]*fileState)
+		for relFilename, s := range state.Files {
+			states[filepath.Join(dirname, filepath.FromSlash(relFilename))] = s
+		}
+		if err = mergeMetrics(states, dirname); err != nil {
+			return counts, time.Time{}, err
+		}
+	}
+	var next time.Time
+	for _, s := range state.Files {
+		due := time.Unix(s.Verified, 0).Add(scrubInterval)
+		if next.IsZero() || due.Before(next) {
+			next = due
+		}
+	}
+	return counts, next, nil
+}
+
+// findPresFiles returns the slash separated paths of all *.pres files
+// below dirname, relative to dirname and sorted. Paths below dirname,
+// that cannot be read, are reported and skipped; they are returned as
+// unreadable, in the same form.
+func findPresFiles(dirname string) (relFilenames, unreadable []string, err error) {
+	err = filepath.Walk(dirname, func(filename string, info os.FileInfo, err error) error {
+		if err != nil && filename == dirname {
+			return err
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping '%s': %s\n", filename, err.Error())
+			if relFilename, err := filepath.Rel(dirname, filename); err == nil {
+				unreadable = append(unreadable, filepath.ToSlash(relFilename))
+			}
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || !strings.HasSuffix(filename, ".pres") {
+			return nil
+		}
+		relFilename, err := filepath.Rel(dirname, filename)
+		if err != nil {
+			return err
+		}
+		relFilenames = append(relFilenames, filepath.ToSlash(relFilename))
+		return nil
+	})
+	sort.Strings(relFilenames)
+	return relFilenames, unreadable, err
+}
+
+// isBelowAny reports whether relFilename is one of the paths or lies
+// below one of them.
+func isBelowAny(relFilename string, paths []string) bool {
+	for _, p := range paths {
+		if relFilename == p || strings.HasPrefix(relFilename, p+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestScrubRepairsDamagedFiles(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "pres_test_scrub_*")
+	if err != nil {
+		t.Fatalf("Error creating temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dirname)
+	dataFilename, err := createTestInputWithSize(100000)
+	if err != nil {
+		t.Fatalf("Error creating tempfile: %s", err.Error())
+	}
+	defer os.Remove(dataFilename)
+	presFilename := filepath.Join(dirname, "data.pres")
+	outFilename = presFilename
+	defer func() { outFilename = "" }()
+	createPresFile(dataFilename)
+	outFilename = ""
+	conf, err := getConf(presFilename)
+	if err != nil {
+		t.Fatalf("Error reading conf: %s", err.Error())
+	}
+	if err = damageShard(presFilename, conf, 1); err != nil {
+		t.Fatalf("Error damaging shard: %s", err.Error())
+	}
+	defer func() { scrubStateFilename, scrubRepair, scrubInterval = "", false, 0 }()
+	scrubStateFilename, scrubRepair, scrubInterval = filepath.Join(dirname, "state.json"), true, time.Hour
+
+	if _, _, err = scrubPass(dirname, ioutil.Discard); err != nil {
+		t.Fatalf("Error scrubbing: %s", err.Error())
+	}
+	state, err := loadScrubState(scrubStateFilename)
+	if err != nil {
+		t.Fatalf("Error loading state: %s", err.Error())
+	}
+	if s := state.Files["data.pres"]; s == nil || s.Result != resultRepaired {
+		t.Fatalf("State of the damaged file is %v", s)
+	}
+	if report := checkFile(presFilename, false); report.Result != resultIntact {
+		t.Errorf("The repaired file is %s", report.Result)
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	for s, expected := range map[string]time.Duration{"30d": 30 * 24 * time.Hour, "12h": 12 * time.Hour} {
+		if d, err := parseAge(s); err != nil || d != expected {
+			t.Errorf("Parsed '%s' as %v, %v instead of %v", s, d, err, expected)
+		}
+	}
+	for _, s := range []string{"", "d", "-1d", "0s", "1x"} {
+		if _, err := parseAge(s); err == nil {
+			t.Errorf("Parsed invalid duration '%s'", s)
+		}
+	}
+}
+
+func TestChangedFilesAreDue(t *testing.T) {
+	file, err := ioutil.TempFile("", "pres_test_state_*")
+	if err != nil {
+		t.Fatalf("Error creating tempfile: %s", err.Error())
+	}
+	defer os.Remove(file.Name())
+	file.Close()
+	info, err := os.Stat(file.Name())
+	if err != nil {
+		t.Fatalf("Error reading file info: %s", err.Error())
+	}
+	s := newFileState(resultIntact, fileCounts{}, info)
+	if s.isDue(info, time.Hour) {
+		t.Errorf("An unchanged file, that was just verified, is due")
+	}
+	if !s.isDue(info, time.Nanosecond) {
+		t.Errorf("A file, that was verified before the interval, is not due")
+	}
+	ioutil.WriteFile(file.Name(), []byte("changed"), 0644)
+	if info, err = os.Stat(file.Name()); err != nil {
+		t.Fatalf("Error reading file info: %s", err.Error())
+	}
+	if !s.isDue(info, time.Hour) {
+		t.Errorf("A changed file is not due")
+	}
+}
+
+func TestSkippedDamagedFilesFailVerification(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "pres_test_scrub_*")
+	if err != nil {
+		t.Fatalf("Error creating temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dirname)
+	dataFilename, err := createTestInputWithSize(100000)
+	if err != nil {
+		t.Fatalf("Error creating tempfile: %s", err.Error())
+	}
+	defer os.Remove(dataFilename)
+	presFilename := filepath.Join(dirname, "data.pres")
+	outFilename = presFilename
+	defer func() { outFilename = "" }()
+	createPresFile(dataFilename)
+	outFilename = ""
+	conf, err := getConf(presFilename)
+	if err != nil {
+		t.Fatalf("Error reading conf: %s", err.Error())
+	}
+	if err = damageShard(presFilename, conf, 1); err != nil {
+		t.Fatalf("Error damaging shard: %s", err.Error())
+	}
+	defer func() { scrubStateFilename, scrubInterval = "", 0 }()
+	scrubStateFilename, scrubInterval = filepath.Join(dirname, "state.json"), time.Hour
+
+	for pass := 1; pass <= 2; pass += 1 {
+		counts, _, err := scrubPass(dirname, ioutil.Discard)
+		if err != nil {
+			t.Fatalf("Error in pass %d: %s", pass, err.Error())
+		}
+		if counts[resultDamaged] != 1 {
+			t.Errorf("Pass %d counted %d damaged file(s) instead of 1", pass, counts[resultDamaged])
+		}
+		if status := getScrubExitStatus(counts); status != 8 {
+			t.Errorf("Pass %d has exit status %d instead of 8", pass, status)
+		}
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// listenAddress is set with -listen.
+var listenAddress = "localhost:8080"
+
+// serveTokenFilename is set with -token-file. Clients must send the token
+// from that file or from the PRES_SERVE_TOKEN environment variable as a
+// bearer token.
+var serveTokenFilename string
+
+const serveTokenEnv = "PRES_SERVE_TOKEN"
+
+// serveRetentionFlag is set with -retention. Finished jobs and their
+// restored data are removed after that time.
+var serveRetentionFlag = "1h"
+
+// The types of jobs, that serve runs.
+const (
+	verifyJob  = "verify"
+	repairJob  = "repair"
+	restoreJob = "restore"
+)
+
+// The states of a job.
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// maxQueuedJobs is the number of jobs, that may wait to be run.
+const maxQueuedJobs = 1024
+
+// maxFinishedJobs is the number of finished jobs, that are kept, and
+// maxRestoredJobs the number of them, whose restored data is kept. Older
+// ones are removed before their retention time ends.
+const (
+	maxFinishedJobs = 1024
+	maxRestoredJobs = 4
+)
+
+type job struct {
+	ID       int         `json:"id"`
+	Type     string      `json:"type"`
+	Path     string      `json:"path"` // Slash separated and relative to the root.
+	Status   string      `json:"status"`
+	Report   *fileReport `json:"report,omitempty"` // Of verify and repair jobs.
+	Error    string      `json:"error,omitempty"`
+	Created  int64       `json:"created"` // Unix time.
+	Finished int64       `json:"finished,omitempty"`
+
+	dataFilename string // The restored data of restore jobs.
+	passphrase   []byte // Given with restore jobs of encrypted data.
+	dataRemoved  bool   // Whether the restored data was removed early.
+}
+
+// server runs verify, repair and restore jobs on the *.pres files below
+// root, one after another, using the same functions as the commands.
+//
+// Restore jobs write the complete data to dataDir, before it can be
+// downloaded, instead of streaming it into a response: restoring starts
+// over, when it finds damage, which is impossible once data was sent, and
+// the data must still be available after the job ran. dataDir therefore
+// needs room for the data of up to maxRestoredJobs jobs.
+type server struct {
+	root      string
+	dataDir   string // Holds the restored data until the job is removed.
+	token     []byte
+	retention time.Duration
+	mutex     sync.Mutex
+	jobs      map[int]*job
+	nextID    int
+	queue     chan *job
+}
+
+func newServer(root, dataDir string, token []byte, retention time.Duration) *server {
+	s := &server{
+		root:      root,
+		dataDir:   dataDir,
+		token:     token,
+		retention: retention,
+		jobs:      make(map[int]*job),
+		nextID:    1,
+		queue:     make(chan *job, maxQueuedJobs),
+	}
+	go s.runJobs()
+	go func() {
+		for range time.Tick(time.Minute) {
+			s.pruneJobs()
+		}
+	}()
+	return s
+}
+
+func loadServeToken() ([]byte, error) {
+	var token []byte
+	if serveTokenFilename != "" {
+		content, err := ioutil.ReadFile(serveTokenFilename)
+		if err != nil {
+			return nil, err
+		}
+		token = bytes.TrimSuffix(bytes.TrimSuffix(content, []byte("\n")), []byte("\r"))
+	} else if env, ok := os.LookupEnv(serveTokenEnv); ok {
+		token = []byte(env)
+	}
+	if len(token) == 0 {
+		return nil, fmt.Errorf("a token is needed; give it with -token-file or in %s", serveTokenEnv)
+	}
+	return token, nil
+}
+
+// serveDirectory serves the HTTP API for the *.pres files below root
+// until the process is terminated.
+func serveDirectory(root string) {
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		fmt.Fprintf(os.Stderr, "'%s' is not a directory.\n", root)
+		os.Exit(1)
+	}
+	token, err := loadServeToken()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading token:", err.Error())
+		os.Exit(1)
+	}
+	retention, err := parseAge(serveRetentionFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid option:", err.Error())
+		os.Exit(1)
+	}
+	dataDir, err := ioutil.TempDir(tmpDirname, "pres_serve_*")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error creating temporary directory:", err.Error())
+		os.Exit(1)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		os.RemoveAll(dataDir)
+		os.Exit(0)
+	}()
+	fmt.Fprintf(os.Stderr, "Serving '%s' on %s.\n", root, listenAddress)
+	err = http.ListenAndServe(listenAddress, newServer(root, dataDir, token, retention))
+	os.RemoveAll(dataDir)
+	fmt.Fprintln(os.Stderr, "Error serving:", err.Error())
+	os.Exit(1)
+}
+
+// ServeHTTP handles these requests, which must carry the token:
+//
+//	GET    /jobs           lists all jobs
+//	POST   /jobs           enqueues a job, given as {"type": ..., "path": ...}
+//	GET    /jobs/ID        returns a job, including its report
+//	DELETE /jobs/ID        removes a finished job and its restored data
+//	GET    /jobs/ID/data   returns the restored data of a restore job
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") ||
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), s.token) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSONError(w, http.StatusUnauthorized, "missing or wrong token")
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "jobs" || len(parts) > 3 || (len(parts) == 3 && parts[2] != "data") {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if len(parts) == 1 {
+		switch r.Method {
+		case http.MethodGet:
+			s.listJobs(w)
+		case http.MethodPost:
+			s.addJob(w, r)
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+		return
+	}
+	id, err := strconv.Atoi(parts[1])
+	s.mutex.Lock()
+	j := s.jobs[id]
+	s.mutex.Unlock()
+	if err != nil || j == nil {
+		writeJSONError(w, http.StatusNotFound, "no such job")
+		return
+	}
+	switch {
+	case len(parts) == 3 && r.Method == http.MethodGet:
+		s.serveData(w, r, j)
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		writeJSON(w, http.StatusOK, j)
+	case len(parts) == 2 && r.Method == http.MethodDelete:
+		s.deleteJob(w, j)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *server) listJobs(w http.ResponseWriter) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	jobs := make([]*job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].ID < jobs[b].ID })
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+func (s *server) addJob(w http.ResponseWriter, r *http.Request) {
+	var request struct{ Type, Path, Passphrase string }
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+		return
+	}
+	if request.Type != verifyJob && request.Type != repairJob && request.Type != restoreJob {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("unknown job type '%s'", request.Type))
+		return
+	}
+	if _, err := s.resolvePath(request.Path); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	j := &job{
+		ID:      s.nextID,
+		Type:    request.Type,
+		Path:    request.Path,
+		Status:  jobQueued,
+		Created: time.Now().Unix(),
+	}
+	if request.Type == restoreJob && request.Passphrase != "" {
+		j.passphrase = []byte(request.Passphrase)
+	}
+	select {
+	case s.queue <- j:
+	default:
+		writeJSONError(w, http.StatusServiceUnavailable, "too many queued jobs")
+		return
+	}
+	s.jobs[j.ID] = j
+	s.nextID += 1
+	writeJSON(w, http.StatusAccepted, j)
+}
+
+// resolvePath returns the name of the *.pres file at the slash
+// separated path p below the root. Paths, that lead out of the root,
+// also through symbolic links, are rejected.
+func (s *server) resolvePath(p string) (string, error) {
+	if !isLocalPath(p) || !strings.HasSuffix(p, ".pres") {
+		return "", fmt.Errorf("invalid path '%s'", p)
+	}
+	filename, err := filepath.EvalSymlinks(filepath.Join(s.root, filepath.FromSlash(p)))
+	if err != nil {
+		return "", fmt.Errorf("'%s' cannot be found", p)
+	}
+	root, err := filepath.EvalSymlinks(s.root)
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(root, filename); err != nil || !isLocalPath(filepath.ToSlash(rel)) {
+		return "", fmt.Errorf("'%s' lies outside of the served directory", p)
+	}
+	if info, err := os.Stat(filename); err != nil || !info.Mode().IsRegular() {
+		return "", fmt.Errorf("'%s' is not a regular file", p)
+	}
+	return filename, nil
+}
+
+// serveData sends the restored data of j. The file is opened while the
+// mutex is locked, so that pruneJobs cannot remove it before; once it is
+// open, it can still be read after it was removed.
+func (s *server) serveData(w http.ResponseWriter, r *http.Request, j *job) {
+	s.mutex.Lock()
+	dataFilename, dataRemoved := j.dataFilename, j.dataRemoved
+	var file *os.File
+	var err error
+	if dataFilename != "" {
+		file, err = os.Open(dataFilename)
+	}
+	s.mutex.Unlock()
+	if dataFilename == "" && dataRemoved {
+		writeJSONError(w, http.StatusGone, "the restored data was removed to make room for newer jobs")
+		return
+	} else if dataFilename == "" {
+		writeJSONError(w, http.StatusConflict, "the job has no restored data")
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer file.Close()
+	name := strings.TrimSuffix(filepath.Base(filepath.FromSlash(j.Path)), ".pres")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	http.ServeContent(w, r, name, time.Time{}, file)
+}
+
+func (s *server) deleteJob(w http.ResponseWriter, j *job) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if j.Status == jobQueued || j.Status == jobRunning {
+		writeJSONError(w, http.StatusConflict, "the job has not finished yet")
+		return
+	}
+	s.removeJob(j)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeJob removes j and its restored data. The mutex must be locked.
+func (s *server) removeJob(j *job) {
+	if j.dataFilename != "" {
+		os.Remove(j.dataFilename)
+	}
+	delete(s.jobs, j.ID)
+}
+
+// pruneJobs removes finished jobs after the retention time and the
+// oldest finished jobs and restored data beyond the limits.
+func (s *server) pruneJobs() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var finished []*job
+	for _, j := range s.jobs {
+		if j.Status == jobDone || j.Status == jobFailed {
+			finished = append(finished, j)
+		}
+	}
+	// Newest first:
+	sort.Slice(finished, func(a, b int) bool { return finished[a].ID > finished[b].ID })
+	expiry := time.Now().Add(-s.retention).Unix()
+	restoredCnt := 0
+	for i, j := range finished {
+		if i >= maxFinishedJobs || j.Finished < expiry {
+			s.removeJob(j)
+		} else if j.dataFilename != "" {
+			if restoredCnt += 1; restoredCnt > maxRestoredJobs {
+				os.Remove(j.dataFilename)
+				j.dataFilename, j.dataRemoved = "", true
+			}
+		}
+	}
+}
+
+func (s *server) runJobs() {
+	for j := range s.queue {
+		s.mutex.Lock()
+		j.Status = jobRunning
+		s.mutex.Unlock()
+		fmt.Fprintf(os.Stderr, "Running job %d: %s '%s'.\n", j.ID, j.Type, j.Path)
+		report, dataFilename, err := s.runJob(j)
+		s.mutex.Lock()
+		j.Report, j.dataFilename, j.Status = report, dataFilename, jobDone
+		if err != nil {
+			j.Status, j.Error = jobFailed, err.Error()
+		}
+		j.Finished = time.Now().Unix()
+		j.passphrase = nil
+		s.mutex.Unlock()
+		s.pruneJobs()
+	}
+}
+
+func (s *server) runJob(j *job) (*fileReport, string, error) {
+	filename, err := s.resolvePath(j.Path)
+	if err != nil {
+		return nil, "", err
+	}
+	if j.Type != restoreJob {
+		report := checkFile(filename, j.Type == repairJob)
+		report.File = j.Path
+		return &report, "", nil
+	}
+	conf, err := getConf(filename)
+	if err != nil {
+		return nil, "", err
+	}
+	if err = checkKeyed(conf); err != nil {
+		return nil, "", err
+	} else if err = checkHMACKey(conf); err != nil {
+		return nil, "", err
+	} else if conf.archive.isEnabled() {
+		return nil, "", errors.New("archives cannot be restored to a single file; use 'pres extract'")
+	} else if conf.encryption.isEnabled() && j.passphrase == nil {
+		return nil, "", errors.New("the data is encrypted; give the passphrase in the request")
+	}
+	dataFilename := filepath.Join(s.dataDir, strconv.Itoa(j.ID))
+	if err = restoreAny(filename, dataFilename, nil, conf, j.passphrase); err != nil {
+		return nil, "", err
+	}
+	return nil, dataFilename, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testToken = "test token"
+
+func TestServeRunsJobs(t *testing.T) {
+	root, err := ioutil.TempDir("", "pres_test_serve_*")
+	if err != nil {
+		t.Fatalf("Error creating temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(root)
+	dataFilename, err := createTestInputWithSize(100000)
+	if err != nil {
+		t.Fatalf("Error creating tempfile: %s", err.Error())
+	}
+	defer os.Remove(dataFilename)
+	original, err := ioutil.ReadFile(dataFilename)
+	if err != nil {
+		t.Fatalf("Error reading input: %s", err.Error())
+	}
+	defer func() { outFilename, encryptInput, passphrase = "", false, nil }()
+	outFilename = filepath.Join(root, "data.pres")
+	createPresFile(dataFilename)
+	if err = ioutil.WriteFile(dataFilename, original, 0644); err != nil {
+		t.Fatalf("Error writing input: %s", err.Error())
+	}
+	outFilename, encryptInput, passphrase = filepath.Join(root, "secret.pres"), true, []byte("secret")
+	createPresFile(dataFilename)
+	outFilename, encryptInput, passphrase = "", false, nil
+	dataDir := filepath.Join(root, "restored")
+	os.Mkdir(dataDir, 0700)
+	ts := httptest.NewServer(newServer(root, dataDir, []byte(testToken), time.Hour))
+	defer ts.Close()
+
+	verify := postJob(t, ts.URL, `{"type": "verify", "path": "data.pres"}`)
+	restore := postJob(t, ts.URL, `{"type": "restore", "path": "data.pres"}`)
+	lockedRestore := postJob(t, ts.URL, `{"type": "restore", "path": "secret.pres"}`)
+	secretRestore := postJob(t, ts.URL, `{"type": "restore", "path": "secret.pres", "passphrase": "secret"}`)
+	resp := doRequest(t, http.MethodPost, ts.URL+"/jobs", testToken, `{"type": "verify", "path": "../data.pres"}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("A path outside of the root got status %d", resp.StatusCode)
+	}
+	for _, token := range []string{"", "wrong"} {
+		resp = doRequest(t, http.MethodPost, ts.URL+"/jobs", token, `{"type": "repair", "path": "data.pres"}`)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("A request with the token '%s' got status %d", token, resp.StatusCode)
+		}
+	}
+	if j := waitForJob(t, ts.URL, verify); j.Report == nil || j.Report.Result != resultIntact {
+		t.Errorf("Verify job ended with %+v", j)
+	}
+	if j := waitForJob(t, ts.URL, lockedRestore); j.Status != jobFailed {
+		t.Errorf("Restore job of encrypted data without a passphrase ended with %+v", j)
+	}
+	for _, id := range []int{restore, secretRestore} {
+		if j := waitForJob(t, ts.URL, id); j.Status != jobDone {
+			t.Fatalf("Restore job ended with %+v", j)
+		}
+		resp = doRequest(t, http.MethodGet, fmt.Sprintf("%s/jobs/%d/data", ts.URL, id), testToken, "")
+		restored, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !bytes.Equal(restored, original) {
+			t.Errorf("The restored data of job %d differs from the original", id)
+		}
+	}
+}
+
+func TestServePrunesFinishedJobs(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "pres_test_serve_*")
+	if err != nil {
+		t.Fatalf("Error creating temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dataDir)
+	s := newServer(dataDir, dataDir, []byte(testToken), time.Hour)
+	now := time.Now().Unix()
+	for id := 1; id <= maxRestoredJobs+2; id += 1 {
+		j := &job{ID: id, Type: restoreJob, Status: jobDone, Finished: now}
+		j.dataFilename = filepath.Join(dataDir, fmt.Sprint(id))
+		ioutil.WriteFile(j.dataFilename, []byte("data"), 0600)
+		s.jobs[id] = j
+	}
+	s.jobs[1].Finished = now - 2*60*60
+	s.pruneJobs()
+	if s.jobs[1] != nil {
+		t.Errorf("An expired job was kept")
+	}
+	if j := s.jobs[2]; j == nil || j.dataFilename != "" || !j.dataRemoved {
+		t.Errorf("The oldest restored data was kept beyond the limit: %+v", j)
+	}
+	for id := 3; id <= maxRestoredJobs+2; id += 1 {
+		if _, err = os.Stat(s.jobs[id].dataFilename); err != nil {
+			t.Errorf("The restored data of job %d was removed", id)
+		}
+	}
+}
+
+func doRequest(t *testing.T, method, url, token, body string) *http.Response {
+	var r io.Reader
+	if body != "" {
+		r = bytes.NewBufferString(body)
+	}
+	req, err := http.NewRequest(method, url, r)
+	if err != nil {
+		t.Fatalf("Error creating request: %s", err.Error())
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %s", err.Error())
+	}
+	return resp
+}
+
+func postJob(t *testing.T, url, request string) int {
+	resp := doRequest(t, http.MethodPost, url+"/jobs", testToken, request)
+	defer resp.Body.Close()
+	var j job
+	if err := json.NewDecoder(resp.Body).Decode(&j); err != nil || resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Posting job failed with status %d: %v", resp.StatusCode, err)
+	}
+	return j.ID
+}
+
+func waitForJob(t *testing.T, url string, id int) job {
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+		resp := doRequest(t, http.MethodGet, fmt.Sprintf("%s/jobs/%d", url, id), testToken, "")
+		var j job
+		err := json.NewDecoder(resp.Body).Decode(&j)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("Error decoding job: %s", err.Error())
+		}
+		if j.Status == jobDone || j.Status == jobFailed {
+			return j
+		}
+	}
+	t.Fatalf("Job %d did not finish", id)
+	return job{}
+}
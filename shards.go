@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// readAheadSize is the minimum amount of bytes that is read from a
+// shard at once. All shards are read from the same file; reading large
+// windows keeps the disk reading sequentially most of the time, instead
+// of seeking between the shards for every small read.
+const readAheadSize = 4 << 20
+
+// shardReader reads one shard from a file that may be shared with the
+// readers of other shards. It only uses ReadAt, so it does not depend
+// on or change the file's offset.
+type shardReader struct {
+	file   io.ReaderAt
+	offset int64 // The next offset to read from file.
+	end    int64
+	buf    []byte
+	unread []byte
+}
+
+func newShardReader(file io.ReaderAt, offset, size int64) *shardReader {
+	return &shardReader{file: file, offset: offset, end: offset + size}
+}
+
+func (r *shardReader) Read(p []byte) (int, error) {
+	if len(r.unread) == 0 {
+		if r.offset >= r.end {
+			r.buf = nil
+			return 0, io.EOF
+		}
+		if len(p) >= readAheadSize {
+			// The read is large enough by itself; skip the buffer.
+			return r.readAt(p)
+		}
+		if r.buf == nil {
+			r.buf = make([]byte, min64(readAheadSize, r.end-r.offset))
+		}
+		n, err := r.readAt(r.buf)
+		r.unread = r.buf[:n]
+		if n == 0 {
+			return 0, err
+		}
+	}
+	n := copy(p, r.unread)
+	r.unread = r.unread[n:]
+	return n, nil
+}
+
+// readAt fills p from the current offset, without exceeding the end of
+// the shard.
+func (r *shardReader) readAt(p []byte) (int, error) {
+	if int64(len(p)) > r.end-r.offset {
+		p = p[:r.end-r.offset]
+	}
+	n, err := r.file.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF && n == len(p) {
+		err = nil
+	} else if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// getShardBounds returns the offset and size of the i-th shard within a
+// *.pres file. The last data shard may be shorter than the others.
+func getShardBounds(conf conf, i int) (offset, size int64) {
+	shardSize := calculateShardSize(conf.dataLen, conf.dataShardCnt)
+	dataShardCnt := int(conf.dataShardCnt)
+	switch {
+	case i < dataShardCnt-1:
+		return int64(i) * shardSize, shardSize
+	case i == dataShardCnt-1:
+		offset = int64(i) * shardSize
+		return offset, conf.dataLen - offset
+	default:
+		return conf.dataLen + int64(i-dataShardCnt)*shardSize, shardSize
+	}
+}
+
+// newShardReaders returns readers for the first shardCnt shards, that
+// read from file.
+func newShardReaders(file io.ReaderAt, conf conf, shardCnt int) []io.Reader {
+	readers := make([]io.Reader, shardCnt)
+	for i := range readers {
+		offset, size := getShardBounds(conf, i)
+		readers[i] = newShardReader(file, offset, size)
+	}
+	return readers
+}
+
+// useMmap enables reading shards from a memory mapping of the *.pres
+// file, where this is supported.
+var useMmap = true
+
+// mapping is an io.Closer that unmaps memory mapped data.
+type mapping []byte
+
+func (m mapping) Close() error {
+	return munmap(m)
+}
+
+// shardFile is a *.pres file or a volume set, from which shards are
+// read.
+type shardFile interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// openShards opens inFilename for reading its shards. If inFilename is
+// the name of a volume, all volumes of the set are opened.
+func openShards(inFilename string) (shardFile, error) {
+	if isVolumeFilename(inFilename) {
+		return openVolumes(inFilename)
+	}
+	return os.Open(inFilename)
+}
+
+// getShardReaders opens inFilename and returns readers for all data
+// and parity shards. If possible, the shards are read from a memory
+// mapping of the file; otherwise all readers share one file descriptor.
+// The returned io.Closer must be closed once the readers are no longer
+// needed.
+func getShardReaders(inFilename string, conf conf) ([]io.Reader, io.Closer, error) {
+	file, err := openShards(inFilename)
+	if err != nil {
+		return nil, nil, err
+	}
+	shardCnt := conf.shardCnt()
+	readers, closer := newShardReaders(file, conf, shardCnt), io.Closer(file)
+	if file, ok := file.(*os.File); ok && useMmap {
+		if data, err := mmapShards(file, conf, shardCnt); err == nil {
+			file.Close()
+			readers, closer = newMappedShardReaders(data, conf, shardCnt), mapping(data)
+		}
+	}
+	if readLimiter != nil {
+		for i := range readers {
+			readers[i] = &limitedReader{readers[i], readLimiter}
+		}
+	}
+	return readers, closer, nil
+}
+
+// readFull reads len(p) bytes, starting at offset, from file. Like the
+// readers of getShardReaders, it is limited by readLimiter.
+func readFull(file io.ReaderAt, p []byte, offset int64) error {
+	n, err := file.ReadAt(p, offset)
+	if readLimiter != nil {
+		readLimiter.wait(n)
+	}
+	if n == len(p) {
+		return nil
+	} else if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readLimiter limits the rate, at which getShardReaders' readers and
+// readFull read, if it is set.
+var readLimiter *rateLimiter
+
+// rateLimiter spaces out reads, so that on average no more than rate
+// bytes are read per second. It may be shared by concurrent readers.
+type rateLimiter struct {
+	rate  int64
+	mutex sync.Mutex
+	next  time.Time // When the next read may happen.
+}
+
+// wait blocks after n bytes have been read, until reading them is
+// covered by the rate.
+func (l *rateLimiter) wait(n int) {
+	l.mutex.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	delay := l.next.Sub(now)
+	l.mutex.Unlock()
+	time.Sleep(delay)
+}
+
+type limitedReader struct {
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.limiter.wait(n)
+	return n, err
+}
+
+// mmapShards maps the region of file, that contains the shards, into
+// memory. The mapping is refused, if file is too short to contain all
+// shards.
+func mmapShards(file *os.File, conf conf, shardCnt int) ([]byte, error) {
+	offset, size := getShardBounds(conf, shardCnt-1)
+	fileSize, err := getDataLen(file)
+	if err != nil {
+		return nil, err
+	}
+	if fileSize < offset+size {
+		return nil, errors.New("file is too short to contain all shards")
+	}
+	return mmapFile(file, offset+size)
+}
+
+func newMappedShardReaders(data []byte, conf conf, shardCnt int) []io.Reader {
+	readers := make([]io.Reader, shardCnt)
+	for i := range readers {
+		offset, size := getShardBounds(conf, i)
+		readers[i] = bytes.NewReader(data[offset : offset+size])
+	}
+	return readers
+}
+
+// copyShard is like io.CopyBuffer, but a fault while reading memory
+// mapped data, as caused by an unreadable sector, is returned as an
+// error instead of crashing the program.
+func copyShard(w io.Writer, r io.Reader, buf []byte) (err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer recoverFault(&err)
+	_, err = io.CopyBuffer(w, r, buf)
+	return err
+}
+
+// readShard is like io.ReadFull, but returns faults like copyShard.
+func readShard(r io.Reader, buf []byte) (err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer recoverFault(&err)
+	_, err = io.ReadFull(r, buf)
+	return err
+}
+
+// recoverFault stores a memory fault in err. Other panics are passed on.
+func recoverFault(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if fault, ok := r.(interface{ Addr() uintptr }); ok {
+		*err = fmt.Errorf("memory fault at address %#x", fault.Addr())
+		return
+	}
+	panic(r)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+// seekCountingReaderAt counts the reads that do not continue where the
+// previous read ended. On a spinning disk, each of them costs a seek.
+type seekCountingReaderAt struct {
+	r     io.ReaderAt
+	mutex sync.Mutex
+	next  int64
+	seeks int
+}
+
+func (s *seekCountingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	s.mutex.Lock()
+	if off != s.next {
+		s.seeks += 1
+	}
+	s.next = off + int64(len(p))
+	s.mutex.Unlock()
+	return s.r.ReadAt(p, off)
+}
+
+// BenchmarkShardReaders measures the throughput of reading all shards
+// of a *.pres file the way create, verify and restore do, and reports
+// how many seeks a spinning disk would have to perform per GiB.
+func BenchmarkShardReaders(b *testing.B) {
+	presFilename := createBenchPresFile(b, *benchSize)
+	defer os.Remove(presFilename)
+	conf, err := getConf(presFilename)
+	if err != nil {
+		b.Fatalf("Error reading conf: %s", err.Error())
+	}
+	presFile, err := os.Open(presFilename)
+	if err != nil {
+		b.Fatalf("Error opening *.pres file: %s", err.Error())
+	}
+	defer presFile.Close()
+	shardCnt := conf.shardCnt()
+	defaultWorkerCnt := workerCnt
+	defer func() { workerCnt = defaultWorkerCnt }()
+	workerCnt = 1
+
+	b.Run("encode", func(b *testing.B) {
+		file := &seekCountingReaderAt{r: presFile}
+		b.SetBytes(conf.dataLen)
+		for i := 0; i < b.N; i += 1 {
+			readers := newShardReaders(file, conf, int(conf.dataShardCnt))
+			readers[len(readers)-1] = fillLastDataReader(readers[len(readers)-1],
+				conf.dataShardCnt, conf.dataLen)
+			writers := make([]io.Writer, conf.parityShardCnt)
+			for j := range writers {
+				writers[j] = ioutil.Discard
+			}
+			if err := writeParityFiles(readers, conf, writers); err != nil {
+				b.Fatalf("Error encoding: %s", err.Error())
+			}
+		}
+		reportSeeks(b, file.seeks, conf.dataLen)
+	})
+	b.Run("hash", func(b *testing.B) {
+		file := &seekCountingReaderAt{r: presFile}
+		b.SetBytes(conf.dataLen)
+		for i := 0; i < b.N; i += 1 {
+			readers := newShardReaders(file, conf, shardCnt)
+			if _, readErrs := generateHashesFromReaders(readers, conf); readErrs[0] != nil {
+				b.Fatalf("Error hashing: %s", readErrs[0].Error())
+			}
+		}
+		reportSeeks(b, file.seeks, conf.dataLen)
+	})
+}
+
+func reportSeeks(b *testing.B, seeks int, dataLen int64) {
+	gib := float64(dataLen) * float64(b.N) / (1 << 30)
+	b.ReportMetric(float64(seeks)/gib, "seeks/GiB")
+}
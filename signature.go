@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// signingKeyFilename and publicKeyFilename are set with -sign and
+// -pubkey. The keys are loaded into signingKey and publicKey.
+var (
+	signingKeyFilename, publicKeyFilename string
+	signingKey                            ed25519.PrivateKey
+	publicKey                             ed25519.PublicKey
+)
+
+// generateKeys writes a new Ed25519 private key to name and the
+// matching public key to name.pub, both PEM encoded.
+func generateKeys(name string) {
+	pubFilename := fmt.Sprint(name, ".pub")
+	for _, filename := range []string{name, pubFilename} {
+		if _, err := os.Stat(filename); !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "'%s' already exists.\n", filename)
+			os.Exit(1)
+		}
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error generating key:", err.Error())
+		os.Exit(2)
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error encoding private key:", err.Error())
+		os.Exit(2)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error encoding public key:", err.Error())
+		os.Exit(2)
+	}
+	err = writePEM(name, "PRIVATE KEY", privDER, 0600)
+	if err == nil {
+		err = writePEM(pubFilename, "PUBLIC KEY", pubDER, 0644)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing key:", err.Error())
+		os.Exit(3)
+	}
+	fmt.Fprintf(os.Stderr, "Wrote the private key to '%s' and the public key to '%s'.\n",
+		name, pubFilename)
+}
+
+func writePEM(filename, blockType string, der []byte, mode os.FileMode) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	err = pem.Encode(file, &pem.Block{Type: blockType, Bytes: der})
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// loadKeys loads the keys given with -sign, -pubkey and -hmac-key and
+// the passphrase.
+func loadKeys() error {
+	if err := loadHMACKey(); err != nil {
+		return err
+	}
+	if err := loadPassphrase(); err != nil {
+		return err
+	}
+	if signingKeyFilename != "" {
+		der, err := readPEM(signingKeyFilename, "PRIVATE KEY")
+		if err != nil {
+			return err
+		}
+		key, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if signingKey, ok = key.(ed25519.PrivateKey); !ok {
+			return fmt.Errorf("'%s' is not an Ed25519 key", signingKeyFilename)
+		}
+	}
+	if publicKeyFilename != "" {
+		der, err := readPEM(publicKeyFilename, "PUBLIC KEY")
+		if err != nil {
+			return err
+		}
+		key, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if publicKey, ok = key.(ed25519.PublicKey); !ok {
+			return fmt.Errorf("'%s' is not an Ed25519 key", publicKeyFilename)
+		}
+	}
+	return nil
+}
+
+func readPEM(filename, blockType string) ([]byte, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("'%s' does not contain a PEM encoded %s", filename, blockType)
+	}
+	return block.Bytes, nil
+}
+
+// resetSignature removes the signature from conf. If there is a
+// signingKey, its public key is set, so that the conf is signed, when
+// the metadata is written.
+func resetSignature(conf *conf) {
+	conf.dataSHA256 = ""
+	conf.signature = nil
+	conf.publicKey = nil
+	if signingKey != nil {
+		conf.publicKey = signingKey.Public().(ed25519.PublicKey)
+	}
+}
+
+// warnIfSignatureIsRemoved warns, if conf is signed, but the file is
+// rewritten without a signingKey.
+func warnIfSignatureIsRemoved(conf conf) {
+	if conf.signature != nil && signingKey == nil {
+		fmt.Fprintln(os.Stderr, "WARNING: The signature is removed; use -sign to sign the new file.")
+	}
+}
+
+// sign calculates the digest of the data in inFilename and signs conf
+// with signingKey.
+func sign(inFilename string, conf *conf) error {
+	digest, err := getDataSHA256(inFilename, conf.dataLen)
+	if err != nil {
+		return err
+	}
+	conf.dataSHA256 = digest
+	conf.publicKey = signingKey.Public().(ed25519.PublicKey)
+	conf.signature = ed25519.Sign(signingKey, signedMessage(*conf))
+	return nil
+}
+
+// checkSignature checks that the conf of result is signed with key. If
+// all data shards are intact, the data is also compared to the signed
+// digest; dataChecked reports, whether that was possible.
+func checkSignature(inFilename string, result verifyResult, key ed25519.PublicKey) (dataChecked bool, err error) {
+	conf := result.conf
+	if conf.signature == nil {
+		return false, errors.New("the file is not signed")
+	}
+	if !bytes.Equal(conf.publicKey, key) {
+		return false, errors.New("the file was signed with a different key")
+	}
+	if !ed25519.Verify(key, signedMessage(conf), conf.signature) {
+		return false, errors.New("the signature does not match the metadata")
+	}
+	for _, i := range result.damagedShards() {
+		if i < int(conf.dataShardCnt) {
+			return false, nil
+		}
+	}
+	digest, err := getDataSHA256(inFilename, conf.dataLen)
+	if err != nil {
+		return false, err
+	}
+	if digest != conf.dataSHA256 {
+		return true, errors.New("the data does not match the signed digest")
+	}
+	return true, nil
+}
+
+// reportSignature prints, whether the *.pres file is signed with
+// publicKey, and returns false, if it isn't.
+func reportSignature(inFilename string, result verifyResult) bool {
+	dataChecked, err := checkSignature(inFilename, result, publicKey)
+	if err != nil {
+		fmt.Printf("The signature is INVALID: %s.\n", err.Error())
+		return false
+	} else if dataChecked {
+		fmt.Println("The signature is valid.")
+	} else {
+		fmt.Println("The signature of the metadata is valid, but the data could",
+			"not be checked, because data shards are damaged.")
+	}
+	return true
+}
+
+// signedMessage returns a text representation of all fields of conf,
+// except the signature. Unlike the encoding of the metadata, it does not
+// change between versions of the format.
+func signedMessage(conf conf) []byte {
+	var b bytes.Buffer
+	fmt.Fprintln(&b, "[pres_signature]")
+	fmt.Fprintf(&b, "version=%s\n", conf.version)
+	fmt.Fprintf(&b, "data_len=%d\n", conf.dataLen)
+	fmt.Fprintf(&b, "data_shard_cnt=%d\n", conf.dataShardCnt)
+	fmt.Fprintf(&b, "parity_shard_cnt=%d\n", conf.parityShardCnt)
+	fmt.Fprintf(&b, "hash_algorithm=%s\n", conf.hashAlgorithm)
+	for i, hash := range conf.shardHashes {
+		fmt.Fprintf(&b, "shard_%d_%s=%s\n", i+1, conf.hashAlgorithm, hash)
+	}
+	fmt.Fprintf(&b, "filename=%q\n", conf.filename)
+	fmt.Fprintf(&b, "modified=%d\n", conf.modified)
+	fmt.Fprintf(&b, "created=%d\n", conf.created)
+	fmt.Fprintf(&b, "data_sha256=%s\n", conf.dataSHA256)
+	fmt.Fprintf(&b, "public_key=%s\n", base64.StdEncoding.EncodeToString(conf.publicKey))
+	if conf.keyCheck != nil {
+		fmt.Fprintf(&b, "key_check=%x\n", conf.keyCheck)
+	}
+	if e := conf.encryption; e.isEnabled() {
+		fmt.Fprintf(&b, "encryption=%s,%d,%d,scrypt,%d,%d,%d,%x,%x\n", e.cipher,
+			e.chunkSize, e.plainLen, e.scryptLogN, e.scryptR, e.scryptP, e.salt, e.keyCheck)
+	}
+	if c := conf.compression; c.isEnabled() {
+		fmt.Fprintf(&b, "compression=%s,%d\n", c.codec, c.origLen)
+	}
+	if a := conf.archive; a.isEnabled() {
+		fmt.Fprintf(&b, "archive_index=%d,%d\n", a.indexOffset, a.indexLen)
+	}
+	if conf.tarIndex != nil {
+		fmt.Fprintf(&b, "tar_index=%s\n", base64.StdEncoding.EncodeToString(conf.tarIndex))
+	}
+	// The volume is not signed, so that all volumes of a set carry the
+	// signature of the original file.
+	return b.Bytes()
+}
+
+func getDataSHA256(inFilename string, dataLen int64) (string, error) {
+	inFile, err := openShards(inFilename)
+	if err != nil {
+		return "", err
+	}
+	defer inFile.Close()
+	hasher := sha256.New()
+	n, err := io.Copy(hasher, io.NewSectionReader(inFile, 0, dataLen))
+	if err != nil {
+		return "", err
+	} else if n != dataLen {
+		return "", io.ErrUnexpectedEOF
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
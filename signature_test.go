@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestSignatureDetectsTampering(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err.Error())
+	}
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err.Error())
+	}
+	dataFilename, err := createTestInputWithSize(12345)
+	if err != nil {
+		t.Fatalf("Error creating tempfile: %s", err.Error())
+	}
+	signingKey = priv
+	createPresFile(dataFilename)
+	signingKey = nil
+	presFilename := fmt.Sprint(dataFilename, ".pres")
+	defer os.Remove(presFilename)
+	result, err := checkPresFile(presFilename)
+	if err != nil {
+		t.Fatalf("Error checking *.pres file: %s", err.Error())
+	}
+	if result.conf.version != "2" {
+		t.Errorf("Signed file has version %s instead of 2", result.conf.version)
+	}
+	if dataChecked, err := checkSignature(presFilename, result, pub); err != nil || !dataChecked {
+		t.Errorf("Valid signature was not accepted: %v", err)
+	}
+	if _, err = checkSignature(presFilename, result, otherPub); err == nil {
+		t.Errorf("Signature of a different key was accepted")
+	}
+
+	tampered := result
+	tampered.conf.shardHashes = append([]string{"123"}, result.conf.shardHashes[1:]...)
+	if _, err = checkSignature(presFilename, tampered, pub); err == nil {
+		t.Errorf("Signature of tampered metadata was accepted")
+	}
+	tampered = result
+	tampered.conf.dataLen -= 1
+	if _, err = checkSignature(presFilename, tampered, pub); err == nil {
+		t.Errorf("Signature of tampered metadata was accepted")
+	}
+	// result still reports all shards as intact, as if the checksums had
+	// been replaced together with the data:
+	if err = damageShard(presFilename, result.conf, 0); err != nil {
+		t.Fatalf("Error damaging shard: %s", err.Error())
+	}
+	if _, err = checkSignature(presFilename, result, pub); err == nil {
+		t.Errorf("Signature of tampered data was accepted")
+	}
+}
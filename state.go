@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// scrubState records when each *.pres file below a directory was last
+// verified, with which result and what the file looked like then. It is
+// stored as JSON and shared by scrub and verify -r.
+type scrubState struct {
+	Files map[string]*fileState `json:"files"` // Keyed by the slash separated relative path.
+}
+
+type fileState struct {
+	Verified int64  `json:"verified"` // Unix time of the last verification.
+	Result   string `json:"result"`
+	Size     int64  `json:"size"`
+	Modified int64  `json:"modified"` // In nanoseconds since the epoch.
+	Inode    uint64 `json:"inode,omitempty"`
+	fileCounts
+}
+
+// fileCounts are the numbers of intact parts of a *.pres file.
+type fileCounts struct {
+	ConfsIntact      int `json:"confs_intact"`
+	ShardsTotal      int `json:"shards_total"`
+	ShardsIntact     int `json:"shards_intact"`
+	ShardsUnreadable int `json:"shards_unreadable"`
+	ShardsNeeded     int `json:"shards_needed"` // The data shard count.
+}
+
+func getFileCounts(result verifyResult) fileCounts {
+	return fileCounts{
+		ConfsIntact:      result.intactConfCnt,
+		ShardsTotal:      len(result.shardStates),
+		ShardsIntact:     result.intactShardCnt(),
+		ShardsUnreadable: len(result.unreadableShards()),
+		ShardsNeeded:     int(result.conf.dataShardCnt),
+	}
+}
+
+func (c fileCounts) restorable() bool {
+	return c.ConfsIntact > 0 && c.ShardsNeeded > 0 && c.ShardsIntact >= c.ShardsNeeded
+}
+
+func newFileState(result string, counts fileCounts, info os.FileInfo) *fileState {
+	return &fileState{
+		Verified:   time.Now().Unix(),
+		Result:     result,
+		Size:       info.Size(),
+		Modified:   info.ModTime().UnixNano(),
+		Inode:      getInode(info),
+		fileCounts: counts,
+	}
+}
+
+// isDue reports whether the file described by info must be verified,
+// because it was not verified within interval or has changed since.
+func (s *fileState) isDue(info os.FileInfo, interval time.Duration) bool {
+	return s == nil || time.Since(time.Unix(s.Verified, 0)) >= interval ||
+		s.Size != info.Size() || s.Modified != info.ModTime().UnixNano() ||
+		s.Inode != getInode(info)
+}
+
+// loadScrubState reads the state from filename. If the file does not
+// exist yet, an empty state is returned.
+func loadScrubState(filename string) (scrubState, error) {
+	state := scrubState{Files: make(map[string]*fileState)}
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return state, err
+	}
+	if err = json.Unmarshal(b, &state); err != nil {
+		return state, err
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]*fileState)
+	}
+	return state, nil
+}
+
+// save replaces filename with the state. A crash never leaves a
+// partially written state behind.
+func (s scrubState) save(filename string) error {
+	b, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmpFile, err := createTempFile(filepath.Dir(filename), ".pres_state_*")
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Write(append(b, '\n'))
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+	}
+	return err
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// tarMode is set with -tar. The input file is then parsed as a tar file
+// and an index of its members is stored in the conf, so that members can
+// be listed and extracted without reading the whole file. The data
+// itself is protected unchanged.
+var tarMode bool
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// indexTar reads the tar file inFilename and returns the encoded index of
+// its members. The offsets point to the contents of the members within
+// the tar file. Members, whose contents are not stored in one piece,
+// like sparse files, and members with paths, that would lead out of the
+// extracted tree, are left out.
+func indexTar(inFilename string) ([]byte, error) {
+	inFile, err := os.Open(inFilename)
+	if err != nil {
+		return nil, err
+	}
+	defer inFile.Close()
+	counter := &countingReader{r: inFile}
+	tr := tar.NewReader(counter)
+	var entries []archiveEntry
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		entry := archiveEntry{
+			path:     strings.TrimPrefix(path.Clean(hdr.Name), "./"),
+			mode:     hdr.FileInfo().Mode(),
+			modified: hdr.ModTime.UnixNano(),
+			offset:   counter.n,
+		}
+		hasher := sha256.New()
+		if entry.size, err = io.Copy(hasher, tr); err != nil {
+			return nil, err
+		}
+		copy(entry.sha256[:], hasher.Sum(nil))
+		if counter.n-entry.offset != entry.size || !isLocalPath(entry.path) {
+			fmt.Fprintf(os.Stderr, "Leaving '%s' out of the index.\n", hdr.Name)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return encodeArchiveIndex(entries), nil
+}
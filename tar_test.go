@@ -0,0 +1,76 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTarMembersAreExtracted(t *testing.T) {
+	members := map[string][]byte{
+		"./a.txt":   []byte("hello"),
+		"dir/b.bin": make([]byte, 200000),
+		"../evil":   []byte("outside"),
+	}
+	rand.Read(members["dir/b.bin"])
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for name, content := range members {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("Error writing tar header: %s", err.Error())
+		}
+		tw.Write(content)
+	}
+	tw.Close()
+	dataFile, err := ioutil.TempFile("", "pres_test_input_*")
+	if err != nil {
+		t.Fatalf("Error creating tempfile: %s", err.Error())
+	}
+	dataFile.Write(b.Bytes())
+	dataFile.Close()
+	defer func() { tarMode = false }()
+	tarMode = true
+	createPresFile(dataFile.Name())
+	tarMode = false
+	presFilename := fmt.Sprint(dataFile.Name(), ".pres")
+	defer os.Remove(presFilename)
+
+	conf, err := getConf(presFilename)
+	if err != nil {
+		t.Fatalf("Error reading conf: %s", err.Error())
+	}
+	entries, err := readArchiveIndex(presFilename, conf)
+	if err != nil {
+		t.Fatalf("Error reading index: %s", err.Error())
+	}
+	if len(entries) != 2 {
+		t.Errorf("Got %d entries instead of 2", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.path != "dir/b.bin" {
+			continue
+		}
+		shardSize := calculateShardSize(conf.dataLen, conf.dataShardCnt)
+		// The damaged parity shard is skipped, when looking for intact
+		// shards to reconstruct the member from.
+		for _, i := range []int{int(entry.offset/shardSize) + 1, int(conf.dataShardCnt)} {
+			if err = damageShard(presFilename, conf, i); err != nil {
+				t.Fatalf("Error damaging shard: %s", err.Error())
+			}
+		}
+		outFilename := filepath.Join(os.TempDir(), filepath.Base(dataFile.Name())+".b")
+		defer os.Remove(outFilename)
+		if err = extractEntry(presFilename, conf, entry, outFilename); err != nil {
+			t.Fatalf("Error extracting: %s", err.Error())
+		}
+		if content, _ := ioutil.ReadFile(outFilename); !bytes.Equal(content, members["dir/b.bin"]) {
+			t.Errorf("Extracted member differs from the original")
+		}
+	}
+}
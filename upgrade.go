@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// upgradePresFile rewrites a *.pres file with the shard counts given by
+// -data-shards and -parity-shards and the format and hash algorithm
+// given by formatVersion and hashAlgorithm. Settings, that are not
+// given, are kept from the file. Damaged shards
+// are repaired on the way. The original file is only replaced, once the
+// new file is complete and verified, so the data is protected at all
+// times.
+func upgradePresFile(inFilename string) {
+	fmt.Fprintln(os.Stderr, "Checking shards for damage.")
+	result, err := checkPresFile(inFilename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading *.pres file:", err.Error())
+		os.Exit(2)
+	}
+	if result.intactConfCnt == 0 {
+		fmt.Println("Could not find unharmed conf block.")
+		os.Exit(2)
+	} else if !result.restorable() {
+		fmt.Println("Upgrade impossible: not enought shards are intact.")
+		os.Exit(4)
+	}
+	var newConf conf
+	newConf.dataLen = result.conf.dataLen
+	newConf.dataShardCnt = result.conf.dataShardCnt
+	if dataShardCntGiven {
+		newConf.dataShardCnt = dataShardCnt
+	}
+	newConf.parityShardCnt = result.conf.parityShardCnt
+	if parityShardCntGiven {
+		newConf.parityShardCnt = parityShardCnt
+	}
+	if newConf.shardCnt() > maxShardCnt {
+		fmt.Fprintf(os.Stderr, "More than %d shards in total are not supported.\n",
+			maxShardCnt)
+		os.Exit(1)
+	}
+	newConf.dataShardCnt = reduceShardCntIfNecessary(newConf)
+	newConf.encryption = result.conf.encryption
+	newConf.compression = result.conf.compression
+	newConf.archive = result.conf.archive
+	newConf.tarIndex = result.conf.tarIndex
+	newConf.hashAlgorithm = result.conf.hashAlgorithm
+	if hashAlgorithm != "" {
+		newConf.hashAlgorithm = hashAlgorithm
+	}
+	newConf.filename = result.conf.filename
+	if newConf.filename == "" {
+		newConf.filename = strings.TrimSuffix(filepath.Base(inFilename), ".pres")
+	}
+	newConf.modified = result.conf.modified
+	newConf.created = time.Now().UnixNano()
+	resetSignature(&newConf)
+	if newConf.version, err = chooseVersion(newConf, result.conf.version); err != nil {
+		fmt.Fprintln(os.Stderr, "Error choosing the format:", err.Error())
+		os.Exit(1)
+	}
+	if isUpToDate(result, newConf) {
+		fmt.Println("The file is intact and already in the current format.")
+		return
+	}
+	if damagedShards := result.damagedShards(); len(damagedShards) > 0 {
+		fmt.Fprintln(os.Stderr, "Repairing", len(damagedShards), "damaged shard(s).")
+	}
+	warnIfSignatureIsRemoved(result.conf)
+	if err = upgrade(inFilename, result, newConf); err != nil {
+		fmt.Fprintln(os.Stderr, "Error upgrading:", err.Error())
+		os.Exit(3)
+	}
+	fmt.Printf("Upgraded '%s' to version %s.\n", inFilename, newConf.version)
+}
+
+// isUpToDate checks whether a file with the given state is undamaged and
+// already matches newConf, apart from the checksums.
+func isUpToDate(result verifyResult, newConf conf) bool {
+	return result.intactConfCnt == len(confHeaders) &&
+		len(result.damagedShards()) == 0 &&
+		result.conf.version == newConf.version &&
+		result.conf.hashAlgorithm == newConf.hashAlgorithm &&
+		(signingKey == nil || bytes.Equal(result.conf.publicKey, newConf.publicKey)) &&
+		result.conf.dataShardCnt == newConf.dataShardCnt &&
+		result.conf.parityShardCnt == newConf.parityShardCnt
+}
+
+// upgrade writes the restored data of inFilename, together with new
+// parity information and metadata, to a temporary file in the same
+// directory, verifies it and then replaces inFilename with it.
+func upgrade(inFilename string, result verifyResult, newConf conf) error {
+	stat, err := os.Stat(inFilename)
+	if err != nil {
+		return err
+	}
+	tmpFile, err := createTempFile(filepath.Dir(inFilename), ".pres_upgrade_*")
+	if err != nil {
+		return err
+	}
+	tmpFilename := tmpFile.Name()
+	tmpFile.Close()
+	// After a successful upgrade, tmpFilename no longer exists.
+	defer os.Remove(tmpFilename)
+
+	fmt.Fprintln(os.Stderr, "Copying data.")
+	err = restore(inFilename, tmpFilename, result.shardStates, result.conf)
+	if err != nil {
+		return err
+	}
+	if err = protectFile(tmpFilename, newConf); err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "Verifying the new file.")
+	newResult, err := checkPresFile(tmpFilename)
+	if err != nil {
+		return err
+	}
+	if newResult.intactConfCnt != len(confHeaders) || len(newResult.damagedShards()) > 0 {
+		return errors.New("the new file is damaged")
+	}
+	return replaceFile(inFilename, tmpFilename, stat.Mode())
+}
+
+// replaceFile atomically replaces filename with newFilename, after
+// making sure that the content of newFilename is written to disk.
+func replaceFile(filename, newFilename string, mode os.FileMode) error {
+	if err := syncFile(newFilename); err != nil {
+		return err
+	}
+	if err := os.Chmod(newFilename, mode); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Replacing '%s'.\n", filename)
+	return os.Rename(newFilename, filename)
+}
+
+// protectFile appends parity information and metadata to filename.
+func protectFile(filename string, conf conf) error {
+	hashers := getShardsHashers(conf)
+	fmt.Fprintln(os.Stderr, "Calculating parity information and checksums.")
+	parityFilenames, err := makeParityFilesAndCalculateHashes(filename, conf, hashers)
+	if err != nil {
+		return err
+	}
+	defer removeFiles(parityFilenames)
+	if err = copyOverData(filename, parityFilenames...); err != nil {
+		return err
+	}
+	return writeMetadata(filename, conf, hashers)
+}
+
+func syncFile(filename string) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestUpgradeRepairsAndChangesShardCnts(t *testing.T) {
+	dataFilename, err := createTestInputWithSize(12345)
+	if err != nil {
+		t.Fatalf("Error creating tempfile: %s", err.Error())
+	}
+	origFilename := fmt.Sprint(dataFilename, ".orig")
+	defer os.Remove(origFilename)
+	if err = copyFile(dataFilename, origFilename); err != nil {
+		t.Fatalf("Error copying file: %s", err.Error())
+	}
+	createPresFile(dataFilename)
+	presFilename := fmt.Sprint(dataFilename, ".pres")
+	defer os.Remove(presFilename)
+	result, err := checkPresFile(presFilename)
+	if err != nil {
+		t.Fatalf("Error checking *.pres file: %s", err.Error())
+	}
+	if err = damageShard(presFilename, result.conf, 7); err != nil {
+		t.Fatalf("Error damaging shard: %s", err.Error())
+	}
+	if result, err = checkPresFile(presFilename); err != nil {
+		t.Fatalf("Error checking *.pres file: %s", err.Error())
+	}
+
+	newConf := conf{version: "2", dataLen: 12345, dataShardCnt: 20,
+		parityShardCnt: 5, hashAlgorithm: "sha256"}
+	if err = upgrade(presFilename, result, newConf); err != nil {
+		t.Fatalf("Error upgrading: %s", err.Error())
+	}
+	result, err = checkPresFile(presFilename)
+	if err != nil {
+		t.Fatalf("Error checking upgraded file: %s", err.Error())
+	}
+	if result.intactConfCnt != 3 || len(result.damagedShards()) != 0 {
+		t.Errorf("Upgraded file is damaged")
+	}
+	if result.conf.dataShardCnt != 20 || result.conf.parityShardCnt != 5 {
+		t.Errorf("Upgraded file has %d data and %d parity shards instead of 20 and 5",
+			result.conf.dataShardCnt, result.conf.parityShardCnt)
+	}
+	if result.conf.version != "2" || result.conf.hashAlgorithm != "sha256" {
+		t.Errorf("Upgraded file has version %s with %s instead of version 2 with sha256",
+			result.conf.version, result.conf.hashAlgorithm)
+	}
+	err = restore(presFilename, dataFilename, result.shardStates, result.conf)
+	defer os.Remove(dataFilename)
+	if err != nil {
+		t.Fatalf("Error restoring: %s", err.Error())
+	}
+	eq, err := filesAreEqual(origFilename, dataFilename)
+	if err != nil {
+		t.Fatalf("Error comparing files: %s", err.Error())
+	}
+	if !eq {
+		t.Errorf("Restored data does not match the original")
+	}
+}
+
+func TestUpgradeKeepsReencodedShardCnts(t *testing.T) {
+	dataFilename, err := createTestInputWithSize(12345)
+	if err != nil {
+		t.Fatalf("Error creating tempfile: %s", err.Error())
+	}
+	createPresFile(dataFilename)
+	presFilename := fmt.Sprint(dataFilename, ".pres")
+	defer os.Remove(presFilename)
+	conf, err := getConf(presFilename)
+	if err != nil {
+		t.Fatalf("Error reading conf: %s", err.Error())
+	}
+	conf.parityShardCnt = 10
+	if err = reencode(presFilename, conf); err != nil {
+		t.Fatalf("Error reencoding: %s", err.Error())
+	}
+
+	defer func() { hashAlgorithm = "" }()
+	hashAlgorithm = "sha256"
+	upgradePresFile(presFilename)
+	if conf, err = getConf(presFilename); err != nil {
+		t.Fatalf("Error reading conf of upgraded file: %s", err.Error())
+	}
+	if conf.hashAlgorithm != "sha256" || conf.parityShardCnt != 10 {
+		t.Errorf("Upgraded file has %s checksums and %d parity shards instead of sha256 and 10",
+			conf.hashAlgorithm, conf.parityShardCnt)
+	}
+}
@@ -2,10 +2,26 @@ package main
 
 import (
 	"io"
+	"io/ioutil"
 	"os"
 	"strings"
 )
 
+// tmpDirname is the tmpdir setting. If it is empty, the default
+// directory for temporary files is used.
+var tmpDirname string
+
+// createTempFile creates a new temporary file in dir or, if dir is empty,
+// in tmpDirname. Files that are renamed to their destination later must
+// be created next to it, because renaming does not work across file
+// systems.
+func createTempFile(dir, pattern string) (*os.File, error) {
+	if dir == "" {
+		dir = tmpDirname
+	}
+	return ioutil.TempFile(dir, pattern)
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -20,6 +36,13 @@ func min64(a, b int64) int64 {
 	return b
 }
 
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
 func calculateShardSize(dataLen int64, dataShardCnt uint8) int64 {
 	shardSize := dataLen / int64(dataShardCnt)
 	if dataLen%int64(dataShardCnt) > 0 {
@@ -57,3 +80,9 @@ func getDataLen(input *os.File) (int64, error) {
 	}
 	return stat.Size(), nil
 }
+
+func closeAll(closers []io.Closer) {
+	for _, closer := range closers {
+		closer.Close()
+	}
+}
@@ -1,50 +1,113 @@
 package main
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
-	"hash/crc32"
 	"io"
 	"os"
-	"regexp"
-	"strconv"
-	"strings"
+	"sync"
 )
 
+// verifyResult describes the state of a *.pres file.
+type verifyResult struct {
+	confs         []conf // All copies, including damaged ones.
+	intactConfCnt int
+	conf          conf // Only set if intactConfCnt > 0.
+	format        format
+	shardStates   []bool
+	readErrs      []error // The read errors of unreadable shards.
+}
+
+func (r verifyResult) intactShardCnt() int {
+	cnt := 0
+	for _, shardState := range r.shardStates {
+		if shardState == intact {
+			cnt += 1
+		}
+	}
+	return cnt
+}
+
+// unreadableShards returns the indices of all shards, that could not be
+// read.
+func (r verifyResult) unreadableShards() []int {
+	var unreadableShards []int
+	for i, err := range r.readErrs {
+		if err != nil {
+			unreadableShards = append(unreadableShards, i)
+		}
+	}
+	return unreadableShards
+}
+
+// damagedShards returns the indices of all damaged shards.
+func (r verifyResult) damagedShards() []int {
+	var damagedShards []int
+	for i, shardState := range r.shardStates {
+		if shardState == damaged {
+			damagedShards = append(damagedShards, i)
+		}
+	}
+	return damagedShards
+}
+
+func (r verifyResult) restorable() bool {
+	return r.intactConfCnt > 0 && r.intactShardCnt() >= int(r.conf.dataShardCnt)
+}
+
 func verifyPresFile(inFilename string) {
-	confs, err := readConfs(inFilename)
+	if isVolumeFilename(inFilename) {
+		checkVolumesOrExit(inFilename)
+	}
+	result, err := checkConfs(inFilename)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Error reading conf sections:", err.Error())
 		os.Exit(2)
 	}
-	correctConfs := getCorrectConfs(confs)
 	warned := false
-	if len(correctConfs) == 0 {
+	if result.intactConfCnt == 0 {
+		exportMetrics(inFilename, getFileCounts(result))
 		fmt.Println("Could not find unharmed conf block.")
+		if publicKey != nil {
+			fmt.Println("The signature cannot be checked without an intact conf block.")
+		}
 		os.Exit(2)
-	} else if len(correctConfs) < 3 {
+	} else if damagedCnt := len(result.confs) - result.intactConfCnt; damagedCnt == 1 {
 		fmt.Fprintln(os.Stderr, "WARNING: One conf block is damaged!")
 		warned = true
+	} else if damagedCnt > 1 {
+		fmt.Fprintf(os.Stderr, "WARNING: %d conf blocks are damaged!\n", damagedCnt)
+		warned = true
 	} else {
 		fmt.Fprintln(os.Stderr, "All conf blocks are intact.")
 	}
-	conf := correctConfs[0]
-	generatedHashes, err := generateHashes(inFilename, conf)
-	if err != nil {
+	if err = checkKeyed(result.conf); err != nil {
+		fmt.Println("Cannot authenticate: a key was given, but the checksums are not keyed with it.")
+		os.Exit(7)
+	}
+	result.shardStates, result.readErrs, err = checkShards(inFilename, result.conf)
+	if err == errNoHMACKey {
+		fmt.Println("Keyed file, cannot authenticate: the checksums need the key,",
+			"given with -hmac-key or in", hmacKeyEnv+".")
+		os.Exit(6)
+	} else if err != nil {
 		fmt.Fprintln(os.Stderr, "Error calculating hashes:", err.Error())
 		os.Exit(3)
 	}
-	matchingHashes := countMatchingHashes(generatedHashes, conf.shardCRC32Cs)
-	var shardCnt uint8 = conf.dataShardCnt + conf.parityShardCnt
-	fmt.Fprintln(os.Stderr, matchingHashes, "out of", shardCnt,
-		"shards are intact.")
-	if matchingHashes < conf.dataShardCnt {
+	exportMetrics(inFilename, getFileCounts(result))
+	reportUnreadableShards(result.readErrs)
+	fmt.Fprintln(os.Stderr, result.intactShardCnt(), "out of",
+		len(result.shardStates), "shards are intact.")
+	// The signature is reported independently of the damage, also if the
+	// data cannot be restored.
+	signatureValid := publicKey == nil || reportSignature(inFilename, result)
+	if !result.restorable() {
 		fmt.Println("Restoration impossible: not enought shards are intact.")
 		os.Exit(4)
-	} else if matchingHashes < shardCnt {
-		damagedShards := shardCnt - matchingHashes
-		fmt.Fprintln(os.Stderr, "WARNING:", damagedShards,
-			"shard(s) is/are damaged!")
+	} else if damagedShards := result.damagedShards(); len(damagedShards) > 0 {
+		unreadableCnt := len(result.unreadableShards())
+		fmt.Fprintf(os.Stderr, "WARNING: %d shard(s) is/are damaged: %d checksum mismatch(es), %d unreadable!\n",
+			len(damagedShards), len(damagedShards)-unreadableCnt, unreadableCnt)
 		warned = true
 	}
 	if warned {
@@ -53,159 +116,172 @@ func verifyPresFile(inFilename string) {
 	} else {
 		fmt.Println("No problems found.")
 	}
+	if !signatureValid {
+		os.Exit(5)
+	}
 }
 
-func readConfs(inFilename string) ([]conf, error) {
-	confs := make([]conf, 3)
+// checkPresFile checks the conf blocks and, if an intact one is found,
+// all shards of the *.pres file.
+func checkPresFile(inFilename string) (verifyResult, error) {
+	result, err := checkConfs(inFilename)
+	if err != nil || result.intactConfCnt == 0 {
+		return result, err
+	}
+	result.shardStates, result.readErrs, err = checkShards(inFilename, result.conf)
+	return result, err
+}
+
+// checkConfs finds the intact conf blocks of the *.pres file or volume
+// set. The shards are not checked. An error is returned, if the intact
+// conf blocks are of a version, that is not supported.
+func checkConfs(inFilename string) (verifyResult, error) {
+	if isVolumeFilename(inFilename) {
+		return checkVolumeConfs(inFilename)
+	}
+	var result verifyResult
+	confs, format, err := readConfs(inFilename)
+	if err != nil {
+		return result, err
+	}
+	fileSize, err := getFilesize(inFilename)
+	if err != nil {
+		return result, err
+	}
+	result.confs = confs
+	result.format = format
+	correctConfs := getCorrectConfs(confs, fileSize)
+	result.intactConfCnt = len(correctConfs)
+	if len(correctConfs) > 0 {
+		result.conf = correctConfs[0]
+		if result.conf.version != format.version {
+			// A newer version may use the same kind of metadata, but
+			// interpret it differently.
+			return result, fmt.Errorf("unsupported format version '%s'", result.conf.version)
+		}
+		if hashAlgorithms[result.conf.hashAlgorithm] == nil {
+			return result, fmt.Errorf("unsupported hash algorithm '%s'", result.conf.hashAlgorithm)
+		}
+	}
+	return result, nil
+}
+
+// readConfs reads all copies of the conf from inFilename and returns
+// them, together with the format they were read with.
+func readConfs(inFilename string) ([]conf, format, error) {
 	inFile, err := os.Open(inFilename)
 	if err != nil {
-		return nil, err
+		return nil, format{}, err
 	}
 	defer inFile.Close()
 	fileSize, err := getDataLen(inFile)
 	if err != nil {
-		return nil, err
-	}
-	// Seek to a point where the metadata isn't far away (for performance):
-	if _, err = inFile.Seek(-min64(fileSize, 32e3), 2); err != nil {
-		return nil, err
-	}
-	inputReader := bufio.NewReader(inFile)
-	var confIndex int = -1
-	var line string
-	reShard := regexp.MustCompile(`^shard_[0-9]*_crc32c=.*`)
-	for err = nil; err == nil; line, err = inputReader.ReadString('\n') {
-		line = strings.TrimSpace(line)
-		switch line {
-		case "[conf]":
-			confIndex = 0
-			continue
-		case "[conf_copy_1]":
-			confIndex = 1
-			continue
-		case "[conf_copy_2]":
-			confIndex = 2
-			continue
-		}
-		if confIndex < 0 {
-			// There were probably damaged lines at the beginning of the metadata.
+		return nil, format{}, err
+	}
+	for _, format := range formats {
+		confs, err := format.readConfs(inFile, fileSize)
+		if err == errOtherFormat {
 			continue
 		}
-		switch {
-		case strings.HasPrefix(line, "version="):
-			confs[confIndex].version = strings.SplitAfterN(line, "=", 2)[1]
-		case strings.HasPrefix(line, "data_len="):
-			s := strings.SplitAfterN(line, "=", 2)[1]
-			confs[confIndex].dataLen, _ = strconv.ParseInt(s, 10, 64)
-		case strings.HasPrefix(line, "data_shard_cnt="):
-			s := strings.SplitAfterN(line, "=", 2)[1]
-			x, _ := strconv.ParseUint(s, 10, 8)
-			confs[confIndex].dataShardCnt = uint8(x)
-		case strings.HasPrefix(line, "parity_shard_cnt="):
-			s := strings.SplitAfterN(line, "=", 2)[1]
-			x, _ := strconv.ParseUint(s, 10, 8)
-			confs[confIndex].parityShardCnt = uint8(x)
-			shardCnt := confs[confIndex].dataShardCnt + uint8(x)
-			confs[confIndex].shardCRC32Cs = make([]string, shardCnt)
-		case reShard.Match([]byte(line)):
-			s := strings.SplitAfterN(line, "_", 3)[1]
-			s = strings.Trim(s, "_")
-			x, _ := strconv.ParseUint(s, 10, 8)
-			shardIndex := uint8(x - 1)
-			if int(shardIndex) >= len(confs[confIndex].shardCRC32Cs) {
-				// Something went wrong; just go on
-				continue
-			}
-			s = strings.SplitAfterN(line, "=", 2)[1]
-			confs[confIndex].shardCRC32Cs[shardIndex] = s
-		}
-	}
-	if err != nil && err != io.EOF {
-		return nil, err
+		return confs, format, err
 	}
-	return confs, nil
+	return nil, format{}, errors.New("unknown metadata format")
 }
 
-func getCorrectConfs(confs []conf) []conf {
+// getCorrectConfs returns the confs that seem OK for a file of the
+// given size and match at least one other conf.
+func getCorrectConfs(confs []conf, fileSize int64) []conf {
 	correctConfs := make([]conf, 0, 3)
-	if confs[0].seemsOK() &&
+	if confs[0].seemsOK(fileSize) &&
 		(confs[0].equals(confs[1]) || confs[0].equals(confs[2])) {
 		correctConfs = append(correctConfs, confs[0])
 	}
-	if confs[1].seemsOK() &&
+	if confs[1].seemsOK(fileSize) &&
 		(confs[1].equals(confs[0]) || confs[1].equals(confs[2])) {
 		correctConfs = append(correctConfs, confs[1])
 	}
-	if confs[2].seemsOK() &&
+	if confs[2].seemsOK(fileSize) &&
 		(confs[2].equals(confs[1]) || confs[2].equals(confs[0])) {
 		correctConfs = append(correctConfs, confs[2])
 	}
 	return correctConfs
 }
 
-func generateHashes(inFilename string, conf conf) ([]string, error) {
-	readers, files, err := getShardReaders(inFilename, conf)
+// generateHashes returns the hashes of all shards of inFilename. If a
+// shard cannot be read, for example because of an unreadable sector,
+// its hash is empty and the error is stored in readErrs. The other
+// shards are still read.
+func generateHashes(inFilename string, conf conf) (hashes []string, readErrs []error, err error) {
+	if err := checkHMACKey(conf); err != nil {
+		return nil, nil, err
+	}
+	readers, file, err := getShardReaders(inFilename, conf)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	defer func() {
-		for _, file := range files {
-			file.Close()
-		}
-	}()
-	return generateHashesFromReaders(readers, conf)
+	defer file.Close()
+	hashes, readErrs = generateHashesFromReaders(readers, conf)
+	return hashes, readErrs, nil
 }
 
-func countMatchingHashes(generatedHashes, storedHashes []string) uint8 {
-	var matchingHashes uint8
-	if len(generatedHashes) != len(storedHashes) {
-		return 0
+func getShardStates(inFilename string, conf conf) ([]bool, error) {
+	shardStates, _, err := checkShards(inFilename, conf)
+	return shardStates, err
+}
+
+// checkShards compares the hashes of all shards with the conf. Shards,
+// that cannot be read, are damaged; their errors are returned in
+// readErrs.
+func checkShards(inFilename string, conf conf) (shardStates []bool, readErrs []error, err error) {
+	generatedHashes, readErrs, err := generateHashes(inFilename, conf)
+	if err != nil {
+		return nil, nil, err
 	}
-	for i := range generatedHashes {
-		if generatedHashes[i] == storedHashes[i] {
-			matchingHashes += 1
+	shardStates = make([]bool, len(conf.shardHashes))
+	for i, hash := range conf.shardHashes {
+		if readErrs[i] == nil && hash == generatedHashes[i] {
+			shardStates[i] = intact
 		}
 	}
-	return matchingHashes
+	return shardStates, readErrs, nil
 }
 
-func getShardReaders(inFilename string, conf conf) ([]io.Reader, []*os.File, error) {
-	shardSize := calculateShardSize(conf.dataLen, conf.dataShardCnt)
-	files := make([]*os.File, conf.dataShardCnt+conf.parityShardCnt)
-	readers := make([]io.Reader, conf.dataShardCnt+conf.parityShardCnt)
-	for i := 0; i < int(conf.dataShardCnt+conf.parityShardCnt); i += 1 {
-		var err error
-		files[i], err = os.Open(inFilename)
+// reportUnreadableShards prints the read errors of unreadable shards.
+func reportUnreadableShards(readErrs []error) {
+	for i, err := range readErrs {
 		if err != nil {
-			return nil, nil, err
-		}
-		offset := int64(i) * shardSize
-		if i >= int(conf.dataShardCnt) {
-			offset = conf.dataLen + int64(i-int(conf.dataShardCnt))*shardSize
-		}
-		if _, err = files[i].Seek(offset, 0); err != nil {
-			return nil, nil, err
-		}
-		readers[i] = files[i]
-		if i != int(conf.dataShardCnt-1) {
-			readers[i] = io.LimitReader(readers[i], shardSize)
-		} else {
-			size := conf.dataLen - (int64(i) * shardSize)
-			readers[i] = io.LimitReader(readers[i], size)
+			fmt.Fprintf(os.Stderr, "Shard %d is unreadable: %s\n", i+1, err.Error())
 		}
 	}
-	return readers, files, nil
 }
 
-func generateHashesFromReaders(readers []io.Reader, conf conf) ([]string, error) {
+// generateHashesFromReaders hashes the given shards concurrently, using
+// up to workerCnt goroutines. Each shard is read in chunks of
+// readAheadSize bytes. A read error only affects the shard, that it
+// occurred in.
+func generateHashesFromReaders(readers []io.Reader, conf conf) ([]string, []error) {
 	hashes := make([]string, len(readers))
-	hasher := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	readErrs := make([]error, len(readers))
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(workerCnt, len(readers)); w += 1 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hasher := hashAlgorithms[conf.hashAlgorithm]()
+			buf := make([]byte, readAheadSize)
+			for i := range indices {
+				hasher.Reset()
+				if readErrs[i] = copyShard(hasher, readers[i], buf); readErrs[i] == nil {
+					hashes[i] = formatSum(conf.hashAlgorithm, hasher.Sum(nil))
+				}
+			}
+		}()
+	}
 	for i := range readers {
-		if _, err := bufio.NewReader(readers[i]).WriteTo(hasher); err != nil {
-			return nil, err
-		}
-		hashes[i] = fmt.Sprint(hasher.Sum32())
-		hasher.Reset()
+		indices <- i
 	}
-	return hashes, nil
+	close(indices)
+	wg.Wait()
+	return hashes, readErrs
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// Use e.g. "go test -bench Hashes -args -benchsize 4294967296" to
+// benchmark with multi-GB inputs.
+var benchSize = flag.Int64("benchsize", 64<<20,
+	"size of the input file for benchmarks, in bytes")
+
+func BenchmarkGenerateHashes(b *testing.B) {
+	presFilename := createBenchPresFile(b, *benchSize)
+	defer os.Remove(presFilename)
+	conf, err := getConf(presFilename)
+	if err != nil {
+		b.Fatalf("Error reading conf: %s", err.Error())
+	}
+	defaultWorkerCnt := workerCnt
+	defer func() { workerCnt = defaultWorkerCnt }()
+	defaultUseMmap := useMmap
+	defer func() { useMmap = defaultUseMmap }()
+	for _, mmap := range []bool{true, false} {
+		for _, j := range []int{1, 2, 4, 8, 16} {
+			b.Run(fmt.Sprintf("%s/j=%d", benchReadMode(mmap), j), func(b *testing.B) {
+				useMmap, workerCnt = mmap, j
+				b.SetBytes(conf.dataLen)
+				for i := 0; i < b.N; i += 1 {
+					if _, _, err := generateHashes(presFilename, conf); err != nil {
+						b.Fatalf("Error generating hashes: %s", err.Error())
+					}
+				}
+			})
+		}
+	}
+}
+
+func benchReadMode(mmap bool) string {
+	if mmap {
+		return "mmap"
+	}
+	return "read"
+}
+
+// createBenchPresFile creates a *.pres file containing size bytes of
+// random data and returns its name.
+func createBenchPresFile(b *testing.B, size int64) string {
+	dataFile, err := ioutil.TempFile("", "pres_bench_input_*")
+	if err != nil {
+		b.Fatalf("Error creating tempfile: %s", err.Error())
+	}
+	random := rand.New(rand.NewSource(1))
+	_, err = io.CopyN(dataFile, random, size)
+	dataFile.Close()
+	if err != nil {
+		b.Fatalf("Error writing tempfile: %s", err.Error())
+	}
+	createPresFile(dataFile.Name())
+	return fmt.Sprint(dataFile.Name(), ".pres")
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// volumeSize is set with -volume-size. If it is positive, create splits
+// the *.pres file into volumes named <name>.pres.001, <name>.pres.002
+// and so on. Each volume contains a run of whole shards, followed by a
+// copy of the metadata, that also describes the volume. verify and
+// restore read the shards of all volumes through a volumeSet.
+var volumeSize int64
+
+// fillVolumes is set with -fill-volumes. Volumes are then filled up to
+// volumeSize, even if they hold more shards than there are parity
+// shards, so that the loss of a single volume cannot be recovered.
+var fillVolumes bool
+
+// volume describes which shards a volume contains. The zero value
+// describes a *.pres file, that is no volume.
+type volume struct {
+	number, count   uint16 // number starts at 1.
+	shardsPerVolume uint16 // Only the last volume may contain fewer.
+}
+
+func (v volume) isEnabled() bool {
+	return v.count > 0
+}
+
+// shards returns the index of the first shard of the volume and the
+// number of its shards.
+func (v volume) shards(conf conf) (first, cnt int) {
+	first = int(v.number-1) * int(v.shardsPerVolume)
+	return first, min(int(v.shardsPerVolume), conf.shardCnt()-first)
+}
+
+var volumeSuffix = regexp.MustCompile(`\.[0-9]{3}$`)
+
+// isVolumeFilename reports whether filename is the name of a volume,
+// that may also be missing.
+func isVolumeFilename(filename string) bool {
+	if !volumeSuffix.MatchString(filename) {
+		return false
+	}
+	confs, _, err := readConfs(filename)
+	if err != nil {
+		return true
+	}
+	for _, c := range confs {
+		if c.volume.isEnabled() {
+			return true
+		}
+	}
+	return false
+}
+
+func getVolumeFilename(presFilename string, number int) string {
+	return fmt.Sprintf("%s.%03d", presFilename, number)
+}
+
+// parseSize parses sizes like 4G or 650M. The suffixes are powers of
+// 1024.
+func parseSize(s string) (int64, error) {
+	multiplier, digits := int64(1), s
+	if i := strings.IndexAny(s, "KMGT"); i >= 0 && i == len(s)-1 {
+		multiplier = int64(1) << (10 * uint(strings.IndexByte("KMGT", s[i])+1))
+		digits = s[:i]
+	}
+	x, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || x <= 0 || x > (1<<62)/multiplier {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+	return x * multiplier, nil
+}
+
+// getShardsEnd returns the size of a *.pres file without its metadata.
+func getShardsEnd(conf conf) int64 {
+	offset, size := getShardBounds(conf, conf.shardCnt()-1)
+	return offset + size
+}
+
+// chooseVolumeLayout sets the number of data shards of conf, so that
+// its shards can be split into as few volumes of at most volumeSize
+// bytes as possible. Unless fillVolumes is set, a volume holds no more
+// shards than there are parity shards. The number of parity shards is
+// kept and, if all shards fit into a single volume, also the number of
+// data shards. An error is returned, if the data does not fit into 999
+// volumes.
+func chooseVolumeLayout(conf *conf) error {
+	metadataSize, err := getMaxVolumeMetadataSize(*conf)
+	if err != nil {
+		return err
+	}
+	capacity := volumeSize - metadataSize
+	shardSize := calculateShardSize(conf.dataLen, conf.dataShardCnt)
+	if capacity >= int64(conf.shardCnt())*shardSize {
+		return nil
+	}
+	parityCnt := int64(conf.parityShardCnt)
+	maxShardsPerVolume := parityCnt
+	if fillVolumes {
+		maxShardsPerVolume = maxShardCnt
+	}
+	// More shards per volume mean fewer volumes:
+	for shardsPerVolume := maxShardsPerVolume; shardsPerVolume >= 1; shardsPerVolume -= 1 {
+		maxShardSize := capacity / shardsPerVolume
+		if maxShardSize < 1 {
+			continue
+		}
+		minDataShardCnt := (conf.dataLen + maxShardSize - 1) / maxShardSize
+		count := (minDataShardCnt + parityCnt + shardsPerVolume - 1) / shardsPerVolume
+		// Smaller shards fill the last volume, too:
+		dataCnt := count*shardsPerVolume - parityCnt
+		if count > 999 || dataCnt > 255 || dataCnt+parityCnt > maxShardCnt {
+			continue
+		}
+		candidate := *conf
+		candidate.dataShardCnt = uint8(dataCnt)
+		if reduceShardCntIfNecessary(candidate) != candidate.dataShardCnt {
+			continue
+		}
+		conf.dataShardCnt = candidate.dataShardCnt
+		return nil
+	}
+	return fmt.Errorf("%d bytes of data and %d parity shards do not fit into 999 volumes of %d bytes",
+		conf.dataLen, parityCnt, volumeSize)
+}
+
+// getMaxVolumeMetadataSize returns the size of the metadata of a volume
+// of conf with up to maxShardCnt shards. The checksums, signature and
+// key check are not known yet, so placeholders of their size are used.
+func getMaxVolumeMetadataSize(conf conf) (int64, error) {
+	format, err := getFormat(conf.version)
+	if err != nil {
+		return 0, err
+	}
+	hasher := hashAlgorithms[conf.hashAlgorithm]()
+	conf.shardHashes = make([]string, maxShardCnt)
+	for i := range conf.shardHashes {
+		conf.shardHashes[i] = formatSum(conf.hashAlgorithm, make([]byte, hasher.Size()))
+	}
+	if isKeyed(conf.hashAlgorithm) {
+		conf.keyCheck = getKeyCheck()
+	}
+	if conf.publicKey != nil {
+		conf.dataSHA256 = hex.EncodeToString(make([]byte, sha256.Size))
+		conf.signature = make([]byte, ed25519.SignatureSize)
+	}
+	conf.volume = volume{1, 1, 1}
+	var metadata bytes.Buffer
+	if err = format.writeMetadata(&metadata, conf); err != nil {
+		return 0, err
+	}
+	return int64(metadata.Len()), nil
+}
+
+// createVolumes splits the *.pres file, that was created from
+// inFilename, into volumes.
+func createVolumes(inFilename string) {
+	if err := splitIntoVolumes(getPresFilename(inFilename)); err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing volumes:", err.Error())
+		os.Exit(6)
+	}
+}
+
+// splitIntoVolumes writes the shards and metadata of presFilename to
+// volumes of at most volumeSize bytes and removes presFilename. Unless
+// fillVolumes is set, a volume holds no more shards than there are
+// parity shards, so that any single volume can be lost. The shard
+// counts must have been chosen with chooseVolumeLayout.
+func splitIntoVolumes(presFilename string) error {
+	conf, err := getConf(presFilename)
+	if err != nil {
+		return err
+	}
+	format, err := getFormat(conf.version)
+	if err != nil {
+		return err
+	}
+	probe := conf
+	probe.volume = volume{1, 1, 1}
+	var metadata bytes.Buffer
+	if err = format.writeMetadata(&metadata, probe); err != nil {
+		return err
+	}
+	shardSize := calculateShardSize(conf.dataLen, conf.dataShardCnt)
+	shardsPerVolume := (volumeSize - int64(metadata.Len())) / shardSize
+	if shardsPerVolume < 1 {
+		return fmt.Errorf("a volume must hold at least one shard of %d bytes and %d bytes of metadata",
+			shardSize, metadata.Len())
+	}
+	// A single volume cannot be lost without losing everything anyway:
+	shardsPerVolume = min64(shardsPerVolume, int64(conf.shardCnt()))
+	if !fillVolumes && shardsPerVolume < int64(conf.shardCnt()) {
+		shardsPerVolume = min64(shardsPerVolume, int64(conf.parityShardCnt))
+	}
+	count := (int64(conf.shardCnt()) + shardsPerVolume - 1) / shardsPerVolume
+	if count > 999 {
+		return errors.New("more than 999 volumes would be needed")
+	}
+	if count > 1 && shardsPerVolume > int64(conf.parityShardCnt) {
+		fmt.Fprintf(os.Stderr, "WARNING: A volume holds %d shards, but there are only %d parity shards;"+
+			" the loss of a volume cannot be recovered.\n", shardsPerVolume, conf.parityShardCnt)
+	}
+	inFile, err := os.Open(presFilename)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+	for number := 1; number <= int(count); number += 1 {
+		volumeConf := conf
+		volumeConf.volume = volume{uint16(number), uint16(count), uint16(shardsPerVolume)}
+		filename := getVolumeFilename(presFilename, number)
+		fmt.Fprintf(os.Stderr, "Writing '%s'.\n", filename)
+		if err = writeVolume(filename, inFile, volumeConf, format); err != nil {
+			return err
+		}
+	}
+	return os.Remove(presFilename)
+}
+
+func writeVolume(filename string, inFile io.ReaderAt, conf conf, format format) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	first, cnt := conf.volume.shards(conf)
+	start, _ := getShardBounds(conf, first)
+	lastOffset, lastSize := getShardBounds(conf, first+cnt-1)
+	_, err = io.Copy(file, io.NewSectionReader(inFile, start, lastOffset+lastSize-start))
+	if err == nil {
+		err = format.writeMetadata(file, conf)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// checkVolumesOrExit warns about the missing volumes of the set, that
+// filename belongs to, and exits, if none of the volumes has intact
+// metadata.
+func checkVolumesOrExit(filename string) {
+	presFilename := volumeSuffix.ReplaceAllString(filename, "")
+	conf, err := readVolumeConf(presFilename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading volumes:", err.Error())
+		os.Exit(2)
+	}
+	for number := 1; number <= int(conf.volume.count); number += 1 {
+		v := conf.volume
+		v.number = uint16(number)
+		first, cnt := v.shards(conf)
+		filename := getVolumeFilename(presFilename, number)
+		if _, err := os.Stat(filename); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: Volume '%s' is missing; shards %d to %d are erased.\n",
+				filename, first+1, first+cnt)
+		}
+	}
+}
+
+// volumeSet reads the shards of a volume set, as if they were stored in
+// a single *.pres file, without copying them. Reading the shards of
+// missing or truncated volumes fails, so they count as unreadable.
+type volumeSet struct {
+	conf         conf
+	presFilename string
+	files        []*os.File // Indexed by the volume number minus 1; nil if missing.
+}
+
+// openVolumes opens the volume set, that filename belongs to.
+func openVolumes(filename string) (*volumeSet, error) {
+	presFilename := volumeSuffix.ReplaceAllString(filename, "")
+	conf, err := readVolumeConf(presFilename)
+	if err != nil {
+		return nil, err
+	}
+	s := &volumeSet{conf: conf, presFilename: presFilename, files: make([]*os.File, conf.volume.count)}
+	for i := range s.files {
+		if file, err := os.Open(getVolumeFilename(presFilename, i+1)); err == nil {
+			s.files[i] = file
+		}
+	}
+	return s, nil
+}
+
+// bounds returns the offset and size of the shards of the volume with
+// the given number within the shards of the set.
+func (s *volumeSet) bounds(number int) (offset, size int64) {
+	v := s.conf.volume
+	v.number = uint16(number)
+	first, cnt := v.shards(s.conf)
+	offset, _ = getShardBounds(s.conf, first)
+	lastOffset, lastSize := getShardBounds(s.conf, first+cnt-1)
+	return offset, lastOffset + lastSize - offset
+}
+
+func (s *volumeSet) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for number := 1; number <= len(s.files) && n < len(p); number += 1 {
+		offset, size := s.bounds(number)
+		pos := off + int64(n) - offset
+		if pos >= size {
+			continue
+		}
+		part := p[n : n+int(min64(int64(len(p)-n), size-pos))]
+		m, err := s.readVolume(number, part, pos)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readVolume fills p from the volume with the given number, starting at
+// off. Bytes, that are not on disk, because the volume is missing or
+// truncated, cannot be read.
+func (s *volumeSet) readVolume(number int, p []byte, off int64) (int, error) {
+	filename := getVolumeFilename(s.presFilename, number)
+	file := s.files[number-1]
+	if file == nil {
+		return 0, fmt.Errorf("volume '%s' is missing", filename)
+	}
+	n, err := file.ReadAt(p, off)
+	if err == io.EOF && n < len(p) {
+		return n, fmt.Errorf("volume '%s' is truncated", filename)
+	} else if n == len(p) {
+		return n, nil
+	}
+	return n, err
+}
+
+func (s *volumeSet) Close() error {
+	for _, file := range s.files {
+		if file != nil {
+			file.Close()
+		}
+	}
+	return nil
+}
+
+// checkVolumeConfs is checkConfs for a volume set. The metadata of the
+// volumes only differs in the volume number, so the conf of the set is
+// the one of any intact volume, without the volume number. The copies
+// of the conf in all volumes, that are present, are checked against it;
+// missing volumes are reported by checkVolumesOrExit instead.
+func checkVolumeConfs(filename string) (verifyResult, error) {
+	var result verifyResult
+	presFilename := volumeSuffix.ReplaceAllString(filename, "")
+	c, err := readVolumeConf(presFilename)
+	if err != nil {
+		return result, err
+	}
+	result.conf = c
+	result.conf.volume = volume{}
+	if result.format, err = getFormat(c.version); err != nil {
+		return result, err
+	}
+	var confNames []string
+	for number := 1; number <= int(c.volume.count); number += 1 {
+		volumeFilename := getVolumeFilename(presFilename, number)
+		if _, err := os.Stat(volumeFilename); os.IsNotExist(err) {
+			continue
+		}
+		expected := c
+		expected.volume.number = uint16(number)
+		confs, _, err := readConfs(volumeFilename)
+		for i, name := range result.format.confNames {
+			confNames = append(confNames, fmt.Sprintf("%s of '%s'", name, volumeFilename))
+			var volumeConf conf
+			if err == nil && i < len(confs) {
+				volumeConf = confs[i]
+			}
+			if volumeConf.equals(expected) {
+				result.intactConfCnt += 1
+			}
+			if volumeConf.volume == expected.volume {
+				volumeConf.volume = volume{}
+			}
+			result.confs = append(result.confs, volumeConf)
+		}
+	}
+	result.format.confNames = confNames
+	return result, nil
+}
+
+// readVolumeConf returns the first intact conf of the volumes of
+// presFilename. The confs of different volumes differ only in the
+// volume number.
+func readVolumeConf(presFilename string) (conf, error) {
+	for number := 1; number <= 999; number += 1 {
+		confs, _, err := readConfs(getVolumeFilename(presFilename, number))
+		if err != nil || len(confs) < 2 {
+			continue
+		}
+		for i, c := range confs {
+			if c.volume.isEnabled() && c.dataShardCnt > 0 && c.dataLen > 0 &&
+				c.seemsOK(getShardsEnd(c)) &&
+				(c.equals(confs[(i+1)%len(confs)]) || c.equals(confs[(i+2)%len(confs)])) {
+				return c, nil
+			}
+		}
+	}
+	return conf{}, fmt.Errorf("no volume of '%s' with intact metadata was found", presFilename)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestMissingVolumeIsRecovered(t *testing.T) {
+	dataFilename, err := createTestInputWithSize(300000)
+	if err != nil {
+		t.Fatalf("Error creating tempfile: %s", err.Error())
+	}
+	original, err := ioutil.ReadFile(dataFilename)
+	if err != nil {
+		t.Fatalf("Error reading input: %s", err.Error())
+	}
+	defer func() { formatVersion, volumeSize = "", 0 }()
+	// Many more shards would fit into a volume than there are parity
+	// shards:
+	formatVersion, volumeSize = "2", 64<<10
+	createPresFile(dataFilename)
+	createVolumes(dataFilename)
+	presFilename := fmt.Sprint(dataFilename, ".pres")
+	for number := 1; number <= 999; number += 1 {
+		defer os.Remove(getVolumeFilename(presFilename, number))
+	}
+
+	conf, err := readVolumeConf(presFilename)
+	if err != nil {
+		t.Fatalf("Error reading conf of volumes: %s", err.Error())
+	}
+	if conf.volume.count < 2 || conf.volume.shardsPerVolume > uint16(conf.parityShardCnt) {
+		t.Fatalf("Got %d volumes with %d shards each", conf.volume.count, conf.volume.shardsPerVolume)
+	}
+	os.Remove(getVolumeFilename(presFilename, 2))
+	volumeFilename := getVolumeFilename(presFilename, 1)
+	result, err := checkPresFile(volumeFilename)
+	if err != nil {
+		t.Fatalf("Error checking volumes: %s", err.Error())
+	}
+	if len(result.damagedShards()) != int(conf.volume.shardsPerVolume) {
+		t.Errorf("Damaged shards %v do not match the missing volume", result.damagedShards())
+	}
+	// The second volume starts after the shards of the first one:
+	unreadableShards := result.unreadableShards()
+	if len(unreadableShards) != int(conf.volume.shardsPerVolume) ||
+		unreadableShards[0] != int(conf.volume.shardsPerVolume) {
+		t.Errorf("Unreadable shards %v do not match the missing volume", unreadableShards)
+	}
+	outFilename := fmt.Sprint(dataFilename, ".restored")
+	defer os.Remove(outFilename)
+	if err = restore(volumeFilename, outFilename, result.shardStates, result.conf); err != nil {
+		t.Fatalf("Error restoring: %s", err.Error())
+	}
+	if restored, _ := ioutil.ReadFile(outFilename); !bytes.Equal(restored, original) {
+		t.Errorf("The restored data differs from the original")
+	}
+}
+
+func TestDamagedVolumeMetadataIsReported(t *testing.T) {
+	dataFilename, err := createTestInputWithSize(100000)
+	if err != nil {
+		t.Fatalf("Error creating tempfile: %s", err.Error())
+	}
+	defer os.Remove(dataFilename)
+	defer func() { formatVersion, volumeSize = "", 0 }()
+	formatVersion, volumeSize = "2", 64<<10
+	createPresFile(dataFilename)
+	createVolumes(dataFilename)
+	presFilename := fmt.Sprint(dataFilename, ".pres")
+	for number := 1; number <= 999; number += 1 {
+		defer os.Remove(getVolumeFilename(presFilename, number))
+	}
+
+	volumeFilename := getVolumeFilename(presFilename, 2)
+	file, err := os.OpenFile(volumeFilename, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Error opening volume: %s", err.Error())
+	}
+	info, err := file.Stat()
+	if err == nil {
+		_, err = file.WriteAt([]byte("damage"), info.Size()-200)
+	}
+	file.Close()
+	if err != nil {
+		t.Fatalf("Error damaging volume: %s", err.Error())
+	}
+	result, err := checkConfs(getVolumeFilename(presFilename, 1))
+	if err != nil {
+		t.Fatalf("Error checking volumes: %s", err.Error())
+	}
+	if result.intactConfCnt == 0 || result.intactConfCnt != len(result.confs)-1 {
+		t.Errorf("%d of %d conf blocks are intact, instead of all but one",
+			result.intactConfCnt, len(result.confs))
+	}
+}
+
+func TestVolumeLayoutFitsVolumeSize(t *testing.T) {
+	defer func() { volumeSize, fillVolumes = 0, false }()
+	for _, fill := range []bool{false, true} {
+		volumeSize, fillVolumes = 4<<30, fill
+		c := conf{version: "2", dataLen: 100 << 30, dataShardCnt: 100, parityShardCnt: 3,
+			hashAlgorithm: defaultHashAlgorithm}
+		if err := chooseVolumeLayout(&c); err != nil {
+			t.Fatalf("Error choosing the layout with fillVolumes=%v: %s", fill, err.Error())
+		}
+		metadataSize, err := getMaxVolumeMetadataSize(c)
+		if err != nil {
+			t.Fatalf("Error calculating the metadata size: %s", err.Error())
+		}
+		shardSize := calculateShardSize(c.dataLen, c.dataShardCnt)
+		shardsPerVolume := (volumeSize - metadataSize) / shardSize
+		if !fill && shardsPerVolume < int64(c.parityShardCnt) {
+			t.Errorf("Only %d shards of %d bytes fit into a volume", shardsPerVolume, shardSize)
+		}
+		if count := (int64(c.shardCnt()) + shardsPerVolume - 1) / shardsPerVolume; count > 30 {
+			t.Errorf("%d volumes are needed with fillVolumes=%v", count, fill)
+		}
+	}
+
+	volumeSize = 2 << 10
+	c := conf{version: "2", dataLen: 300000, dataShardCnt: 100, parityShardCnt: 3,
+		hashAlgorithm: defaultHashAlgorithm}
+	if err := chooseVolumeLayout(&c); err == nil {
+		t.Errorf("No error for volumes, that are too small")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for s, expected := range map[string]int64{"4G": 4 << 30, "650M": 650 << 20, "1024": 1024} {
+		if size, err := parseSize(s); err != nil || size != expected {
+			t.Errorf("Parsed '%s' as %d, %v instead of %d", s, size, err, expected)
+		}
+	}
+	for _, s := range []string{"", "G", "-1M", "1X", "9999999999T"} {
+		if _, err := parseSize(s); err == nil {
+			t.Errorf("Parsed invalid size '%s'", s)
+		}
+	}
+}